@@ -0,0 +1,247 @@
+package wsexec
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// AccessTokenQueryParam carries the bearer token for clients that can't set headers, such as browsers.
+	AccessTokenQueryParam = "access_token"
+
+	signedUserQueryParam      = "auth_user"
+	signedGroupsQueryParam    = "auth_groups"
+	signedExpiresQueryParam   = "auth_expires"
+	signedSignatureQueryParam = "auth_signature"
+)
+
+var (
+	ErrUnauthenticated    = errors.New("unauthenticated")
+	ErrMissingCredentials = errors.New("missing credentials")
+)
+
+// Identity is the authenticated user of a session.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+func (id Identity) String() string {
+	if len(id.Groups) == 0 {
+		return id.User
+	}
+	return fmt.Sprintf("%s(%s)", id.User, strings.Join(id.Groups, ","))
+}
+
+// Authenticator identifies the user of a request before it's upgraded to websocket.
+// It returns an error wrapping ErrUnauthenticated when the request can't be trusted,
+// or ErrMissingCredentials when the request carries no credentials it understands.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as Authenticator.
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the identity stored in ctx, or nil if there's none.
+func IdentityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// TokenValidator maps a bearer token to an identity.
+type TokenValidator func(ctx context.Context, token string) (*Identity, error)
+
+type bearerTokenAuthenticator struct {
+	validate TokenValidator
+}
+
+// NewBearerTokenAuthenticator authenticates the token from the "Authorization: Bearer" header,
+// or from the AccessTokenQueryParam query parameter when the header is absent, or from a
+// "base64url.bearer.authorization.k8s.io." subprotocol like browser clients of the apiserver send.
+func NewBearerTokenAuthenticator(validate TokenValidator) Authenticator {
+	return &bearerTokenAuthenticator{validate: validate}
+}
+
+// bearerSubprotocolPrefix is followed by a bearer token encoded with unpadded base64url, it's never
+// negotiated, only a way for browsers to send a token with the websocket handshake.
+const bearerSubprotocolPrefix = "base64url.bearer.authorization.k8s.io."
+
+func subprotocolToken(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if !strings.HasPrefix(protocol, bearerSubprotocolPrefix) {
+			continue
+		}
+		token, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(protocol, bearerSubprotocolPrefix))
+		if err == nil {
+			return string(token)
+		}
+	}
+	return ""
+}
+
+// NewStaticTokenAuthenticator authenticates bearer tokens against a fixed token to identity table.
+func NewStaticTokenAuthenticator(tokens map[string]Identity) Authenticator {
+	return NewBearerTokenAuthenticator(func(ctx context.Context, token string) (*Identity, error) {
+		for t, id := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				id := id
+				return &id, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: invalid token", ErrUnauthenticated)
+	})
+}
+
+func (a *bearerTokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := r.URL.Query().Get(AccessTokenQueryParam)
+	if token == "" {
+		token = subprotocolToken(r)
+	}
+	if header := r.Header.Get("Authorization"); header != "" {
+		const prefix = "bearer "
+		if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+			return nil, fmt.Errorf("%w: malformed authorization header", ErrUnauthenticated)
+		}
+		token = strings.TrimSpace(header[len(prefix):])
+	}
+	if token == "" {
+		return nil, ErrMissingCredentials
+	}
+
+	return a.validate(r.Context(), token)
+}
+
+type signedURLAuthenticator struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewSignedURLAuthenticator authenticates urls signed with SignURL and the same key.
+// The signature covers the path and every query parameter, so a signed url can't be
+// reused for another target or after it expires.
+func NewSignedURLAuthenticator(key []byte) Authenticator {
+	return &signedURLAuthenticator{key: key, now: time.Now}
+}
+
+// SignURL returns a copy of u that authenticates as id until expires.
+func SignURL(key []byte, u *url.URL, id Identity, expires time.Time) *url.URL {
+	signed := *u
+	query := signed.Query()
+	query.Set(signedUserQueryParam, id.User)
+	query.Del(signedGroupsQueryParam)
+	for _, group := range id.Groups {
+		query.Add(signedGroupsQueryParam, group)
+	}
+	query.Set(signedExpiresQueryParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Del(signedSignatureQueryParam)
+	query.Set(signedSignatureQueryParam, urlSignature(key, signed.Path, query))
+	signed.RawQuery = query.Encode()
+	return &signed
+}
+
+func (a *signedURLAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	query := r.URL.Query()
+	signature := query.Get(signedSignatureQueryParam)
+	if signature == "" {
+		return nil, ErrMissingCredentials
+	}
+	query.Del(signedSignatureQueryParam)
+
+	expected := urlSignature(a.key, r.URL.Path, query)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, fmt.Errorf("%w: invalid url signature", ErrUnauthenticated)
+	}
+
+	expires, err := strconv.ParseInt(query.Get(signedExpiresQueryParam), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid url expiration %s", ErrUnauthenticated, err)
+	}
+	if a.now().After(time.Unix(expires, 0)) {
+		return nil, fmt.Errorf("%w: signed url expired", ErrUnauthenticated)
+	}
+
+	return &Identity{
+		User:   query.Get(signedUserQueryParam),
+		Groups: query[signedGroupsQueryParam],
+	}, nil
+}
+
+// urlSignature signs path and the canonical encoding of query, Encode sorts by key.
+func urlSignature(key []byte, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	mac.Write([]byte{'?'})
+	mac.Write([]byte(query.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type clientCertAuthenticator struct{}
+
+// NewClientCertAuthenticator authenticates the verified TLS client certificate, the common name
+// is the user and the organizations are the groups, the same mapping kubernetes uses.
+// The http.Server must be configured to verify client certificates.
+func NewClientCertAuthenticator() Authenticator {
+	return clientCertAuthenticator{}
+}
+
+func (clientCertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrMissingCredentials
+	}
+	if len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, fmt.Errorf("%w: client certificate isn't verified", ErrUnauthenticated)
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName == "" {
+		return nil, fmt.Errorf("%w: client certificate has no common name", ErrUnauthenticated)
+	}
+	return &Identity{
+		User:   subject.CommonName,
+		Groups: subject.Organization,
+	}, nil
+}
+
+type unionAuthenticator []Authenticator
+
+// NewUnionAuthenticator tries each authenticator in order and returns the first identity.
+// Authenticators reporting ErrMissingCredentials are skipped, any other error fails the request.
+func NewUnionAuthenticator(authenticators ...Authenticator) Authenticator {
+	return unionAuthenticator(authenticators)
+}
+
+func (u unionAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range u {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, ErrMissingCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrMissingCredentials
+}
@@ -0,0 +1,82 @@
+package wsexec
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignedURLAuthenticator(t *testing.T) {
+	key := []byte("secret")
+	u, _ := url.Parse("http://127.0.0.1:8080/exec?namespace=default&pod=nginx")
+	id := Identity{User: "alice", Groups: []string{"dev", "ops"}}
+	now := time.Now()
+
+	signed := SignURL(key, u, id, now.Add(time.Minute))
+	tampered := *signed
+	query := tampered.Query()
+	query.Set("pod", "database")
+	tampered.RawQuery = query.Encode()
+
+	testcases := map[string]struct {
+		url  string
+		key  []byte
+		now  time.Time
+		user string
+		err  error
+	}{
+		"valid":      {url: signed.String(), key: key, now: now, user: "alice"},
+		"expired":    {url: signed.String(), key: key, now: now.Add(2 * time.Minute), err: ErrUnauthenticated},
+		"wrong key":  {url: signed.String(), key: []byte("other"), now: now, err: ErrUnauthenticated},
+		"tampered":   {url: tampered.String(), key: key, now: now, err: ErrUnauthenticated},
+		"not signed": {url: u.String(), key: key, now: now, err: ErrMissingCredentials},
+		"other path": {url: "http://127.0.0.1:8080/logs?" + signed.RawQuery, key: key, now: now, err: ErrUnauthenticated},
+	}
+	for k, tc := range testcases {
+		a := &signedURLAuthenticator{key: tc.key, now: func() time.Time { return tc.now }}
+		got, err := a.Authenticate(httptest.NewRequest("GET", tc.url, nil))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected err %v, got %v", k, tc.err, err)
+			continue
+		}
+		if tc.err == nil && (got.User != tc.user || len(got.Groups) != 2) {
+			t.Errorf("%s: unexpected identity %v", k, got)
+		}
+	}
+}
+
+func TestUnionAuthenticator(t *testing.T) {
+	a := NewUnionAuthenticator(
+		NewSignedURLAuthenticator([]byte("secret")),
+		NewStaticTokenAuthenticator(map[string]Identity{"token": {User: "bob"}}),
+	)
+
+	testcases := map[string]struct {
+		url    string
+		header string
+		user   string
+		err    error
+	}{
+		"header token": {url: "/exec", header: "Bearer token", user: "bob"},
+		"query token":  {url: "/exec?access_token=token", user: "bob"},
+		"bad token":    {url: "/exec", header: "Bearer nope", err: ErrUnauthenticated},
+		"bad scheme":   {url: "/exec", header: "Basic token", err: ErrUnauthenticated},
+		"nothing":      {url: "/exec", err: ErrMissingCredentials},
+	}
+	for k, tc := range testcases {
+		r := httptest.NewRequest("GET", tc.url, nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		got, err := a.Authenticate(r)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected err %v, got %v", k, tc.err, err)
+			continue
+		}
+		if tc.err == nil && got.User != tc.user {
+			t.Errorf("%s: expected user %s, got %v", k, tc.user, got)
+		}
+	}
+}
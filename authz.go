@@ -0,0 +1,235 @@
+package wsexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+// Target is what a session execs into, or the port it forwards to when Port is set, or the
+// container whose logs it streams when Logs is set. Image is set for a debug container of that image
+// sharing the processes of the container.
+type Target struct {
+	Namespace string
+	Pod       string
+	Container string
+	Command   []string
+	Port      int
+	Logs      bool
+	Image     string
+}
+
+func (t Target) String() string {
+	if t.Port != 0 {
+		return fmt.Sprintf("%s/%s port %d", t.Namespace, t.Pod, t.Port)
+	}
+	if t.Logs {
+		return fmt.Sprintf("%s/%s/%s logs", t.Namespace, t.Pod, t.Container)
+	}
+	if t.Image != "" {
+		return fmt.Sprintf("%s/%s/%s debug %s %q", t.Namespace, t.Pod, t.Container, t.Image, strings.Join(t.Command, " "))
+	}
+	return fmt.Sprintf("%s/%s/%s %q", t.Namespace, t.Pod, t.Container, strings.Join(t.Command, " "))
+}
+
+// port returns the port as matched by rules, empty for exec sessions.
+func (t Target) port() string {
+	if t.Port == 0 {
+		return ""
+	}
+	return strconv.Itoa(t.Port)
+}
+
+// Authorizer decides whether id may exec into target, it returns an error wrapping ErrForbidden
+// with the reason when it may not. id is nil when no authenticator is configured.
+type Authorizer interface {
+	Authorize(ctx context.Context, id *Identity, target Target) error
+}
+
+// AuthorizerFunc is an adapter to allow the use of ordinary functions as Authorizer.
+type AuthorizerFunc func(ctx context.Context, id *Identity, target Target) error
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, id *Identity, target Target) error {
+	return f(ctx, id, target)
+}
+
+type targetKey struct{}
+
+// WithTarget returns a copy of ctx carrying target.
+func WithTarget(ctx context.Context, target Target) context.Context {
+	return context.WithValue(ctx, targetKey{}, target)
+}
+
+// TargetFrom returns the target stored in ctx, ok is false if there's none.
+func TargetFrom(ctx context.Context) (target Target, ok bool) {
+	target, ok = ctx.Value(targetKey{}).(Target)
+	return
+}
+
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// Rule matches sessions by subject and target with globs, where "*" matches any sequence of
+// characters including "/" and "?" matches one byte. An empty list matches everything.
+// Commands are matched against the command line joined with spaces, so "tail *" allows
+// "tail -f /var/log/app.log" but not "bash". Ports match the port of forward sessions, a rule
+// restricting commands never matches them and a rule restricting ports never matches exec sessions.
+// Logs restricts a rule to log sessions, which rules restricting commands never match either.
+// Images match the image of debug sessions, which only allow rules restricting images match,
+// while a rule restricting images never matches other sessions.
+type Rule struct {
+	Name       string   `json:"name"`
+	Effect     Effect   `json:"effect"`
+	Users      []string `json:"users,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Pods       []string `json:"pods,omitempty"`
+	Containers []string `json:"containers,omitempty"`
+	Commands   []string `json:"commands,omitempty"`
+	Ports      []string `json:"ports,omitempty"`
+	Logs       bool     `json:"logs,omitempty"`
+	Images     []string `json:"images,omitempty"`
+}
+
+// Policy is the content of a rule file.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+type ruleAuthorizer struct {
+	rules []Rule
+}
+
+// NewRuleAuthorizer returns an Authorizer evaluating rules: any matching deny rule forbids the
+// session, otherwise a matching allow rule permits it, and nothing else is allowed.
+func NewRuleAuthorizer(rules []Rule) (Authorizer, error) {
+	for i, rule := range rules {
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return nil, fmt.Errorf("rule %d %q has invalid effect %q", i, rule.Name, rule.Effect)
+		}
+	}
+	return &ruleAuthorizer{rules: rules}, nil
+}
+
+// LoadRuleAuthorizer reads a Policy from a yaml or json file and returns its rule authorizer.
+func LoadRuleAuthorizer(path string) (Authorizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy := Policy{}
+	if err = yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&policy); err != nil {
+		return nil, fmt.Errorf("decode policy %s %w", path, err)
+	}
+	return NewRuleAuthorizer(policy.Rules)
+}
+
+func (a *ruleAuthorizer) Authorize(ctx context.Context, id *Identity, target Target) error {
+	allowed := false
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.matches(id, target) {
+			continue
+		}
+		if rule.Effect == EffectDeny {
+			return fmt.Errorf("%w: denied by rule %q", ErrForbidden, rule.Name)
+		}
+		allowed = true
+	}
+	if !allowed {
+		return fmt.Errorf("%w: no rule allows %s to exec %s", ErrForbidden, auditUser(id), target)
+	}
+	return nil
+}
+
+func (r *Rule) matches(id *Identity, target Target) bool {
+	if len(r.Users) > 0 || len(r.Groups) > 0 {
+		if id == nil {
+			return false
+		}
+		if !matchAnyOf(r.Users, []string{id.User}) && !matchAnyOf(r.Groups, id.Groups) {
+			return false
+		}
+	}
+
+	if r.Logs && !target.Logs || target.Logs && len(r.Commands) > 0 {
+		return false
+	}
+	// debugging must be allowed explicitly, deny rules apply to debug sessions all the same
+	if target.Image == "" && len(r.Images) > 0 || target.Image != "" && len(r.Images) == 0 && r.Effect == EffectAllow {
+		return false
+	}
+
+	return matchAny(r.Namespaces, target.Namespace) &&
+		matchAny(r.Pods, target.Pod) &&
+		matchAny(r.Containers, target.Container) &&
+		matchAny(r.Commands, strings.Join(target.Command, " ")) &&
+		matchAny(r.Ports, target.port()) &&
+		matchAny(r.Images, target.Image)
+}
+
+// matchAny reports whether s matches one of patterns, an empty patterns matches everything.
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if globMatch(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyOf reports whether one of values matches one of patterns, an empty patterns matches nothing
+// since it's only consulted when a rule restricts subjects.
+func matchAnyOf(patterns []string, values []string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	for _, v := range values {
+		if matchAny(patterns, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, s string) bool {
+	// star and next are the positions to resume from after the last "*", -1 when there's none
+	star, next := -1, -1
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star != -1:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,111 @@
+package wsexec
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `
+rules:
+- name: read-only-support
+  effect: allow
+  groups: ["support"]
+  namespaces: ["prod-*"]
+  commands: ["ls*", "cat *", "tail *"]
+- name: support-debug-ports
+  effect: allow
+  groups: ["support"]
+  namespaces: ["prod-*"]
+  ports: ["6060", "9?99"]
+- name: support-logs
+  effect: allow
+  groups: ["support"]
+  namespaces: ["prod-*"]
+  logs: true
+- name: support-debug-images
+  effect: allow
+  groups: ["support"]
+  namespaces: ["prod-*"]
+  images: ["busybox*"]
+- name: developers
+  effect: allow
+  groups: ["dev"]
+  namespaces: ["dev-*"]
+- name: no-sidecars
+  effect: deny
+  containers: ["istio-proxy"]
+`
+
+func TestRuleAuthorizer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := LoadRuleAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	support := &Identity{User: "alice", Groups: []string{"support"}}
+	dev := &Identity{User: "bob", Groups: []string{"dev"}}
+	testcases := map[string]struct {
+		id      *Identity
+		target  Target
+		allowed bool
+	}{
+		"support tail":          {id: support, target: Target{Namespace: "prod-a", Pod: "web", Container: "app", Command: []string{"tail", "-f", "/var/log/app.log"}}, allowed: true},
+		"support shell":         {id: support, target: Target{Namespace: "prod-a", Pod: "web", Container: "app", Command: []string{"bash"}}},
+		"support pprof":         {id: support, target: Target{Namespace: "prod-a", Pod: "web", Port: 6060}, allowed: true},
+		"support jmx":           {id: support, target: Target{Namespace: "prod-a", Pod: "web", Port: 9999}, allowed: true},
+		"support app port":      {id: support, target: Target{Namespace: "prod-a", Pod: "web", Port: 8080}},
+		"support logs":          {id: support, target: Target{Namespace: "prod-a", Pod: "web", Container: "app", Logs: true}, allowed: true},
+		"support dev logs":      {id: support, target: Target{Namespace: "dev-a", Pod: "web", Container: "app", Logs: true}},
+		"support debug":         {id: support, target: Target{Namespace: "prod-a", Pod: "web", Container: "app", Command: []string{"sh"}, Image: "busybox:1.36"}, allowed: true},
+		"support debug curl":    {id: support, target: Target{Namespace: "prod-a", Pod: "web", Container: "app", Command: []string{"sh"}, Image: "curlimages/curl"}},
+		"support debug sidecar": {id: support, target: Target{Namespace: "prod-a", Pod: "web", Container: "istio-proxy", Image: "busybox"}},
+		"support dev ns":        {id: support, target: Target{Namespace: "dev-a", Pod: "web", Container: "app", Command: []string{"ls"}}},
+		"dev shell":             {id: dev, target: Target{Namespace: "dev-a", Pod: "web", Container: "app", Command: []string{"bash"}}, allowed: true},
+		"dev logs":              {id: dev, target: Target{Namespace: "dev-a", Pod: "web", Container: "app", Logs: true}, allowed: true},
+		"dev debug":             {id: dev, target: Target{Namespace: "dev-a", Pod: "web", Container: "app", Command: []string{"sh"}, Image: "busybox"}},
+		"dev prod":              {id: dev, target: Target{Namespace: "prod-a", Pod: "web", Container: "app", Command: []string{"ls"}}},
+		"dev sidecar":           {id: dev, target: Target{Namespace: "dev-a", Pod: "web", Container: "istio-proxy", Command: []string{"sh"}}},
+		"anonymous":             {target: Target{Namespace: "dev-a", Pod: "web", Container: "app", Command: []string{"sh"}}},
+		"user without role":     {id: &Identity{User: "carol"}, target: Target{Namespace: "dev-a", Pod: "web", Container: "app", Command: []string{"sh"}}},
+	}
+	for k, tc := range testcases {
+		err := a.Authorize(context.Background(), tc.id, tc.target)
+		if tc.allowed && err != nil {
+			t.Errorf("%s: expected allowed, got %v", k, err)
+		}
+		if !tc.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: expected forbidden, got %v", k, err)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	testcases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{pattern: "*", s: "", match: true},
+		{pattern: "*", s: "a/b c", match: true},
+		{pattern: "prod-*", s: "prod-", match: true},
+		{pattern: "prod-*", s: "staging", match: false},
+		{pattern: "cat *", s: "cat /etc/hosts", match: true},
+		{pattern: "cat *", s: "cat", match: false},
+		{pattern: "a*b*c", s: "axxbyyc", match: true},
+		{pattern: "a*b*c", s: "axxbyy", match: false},
+		{pattern: "web-?", s: "web-1", match: true},
+		{pattern: "web-?", s: "web-12", match: false},
+	}
+	for _, tc := range testcases {
+		if got := globMatch(tc.pattern, tc.s); got != tc.match {
+			t.Errorf("globMatch(%q, %q) = %v, expected %v", tc.pattern, tc.s, got, tc.match)
+		}
+	}
+}
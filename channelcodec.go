@@ -0,0 +1,158 @@
+package wsexec
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kuberemotecommand "k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Websocket subprotocols of the Kubernetes apiserver exec, enable them with
+// WithSessionManagerSubprotocols(KubernetesSubprotocols...) to serve frontends speaking them.
+const (
+	SubprotocolChannel         = "channel.k8s.io"
+	SubprotocolBase64Channel   = "base64.channel.k8s.io"
+	SubprotocolV4Channel       = "v4.channel.k8s.io"
+	SubprotocolV4Base64Channel = "v4.base64.channel.k8s.io"
+)
+
+// KubernetesSubprotocols are the Kubernetes subprotocols, most recent first.
+var KubernetesSubprotocols = []string{
+	SubprotocolV4Channel,
+	SubprotocolV4Base64Channel,
+	SubprotocolChannel,
+	SubprotocolBase64Channel,
+}
+
+// Channels of the Kubernetes subprotocols, every message starts with its channel.
+const (
+	stdinChannel byte = iota
+	stdoutChannel
+	stderrChannel
+	errorChannel
+	resizeChannel
+)
+
+// channelCodec is the protocol of the Kubernetes apiserver exec. With a TTY stderr is merged into
+// stdout, so output always goes to the stdout channel. The error channel carries the exit status,
+// as a metav1.Status since v4 and as a plain error message before.
+type channelCodec struct {
+	base64 bool
+	v4     bool
+}
+
+func newChannelCodec(subprotocol string) channelCodec {
+	return channelCodec{
+		base64: subprotocol == SubprotocolBase64Channel || subprotocol == SubprotocolV4Base64Channel,
+		v4:     subprotocol == SubprotocolV4Channel || subprotocol == SubprotocolV4Base64Channel,
+	}
+}
+
+// greeting is an empty message on stdout, it tells the client the stream is established.
+func (c channelCodec) greeting() ([]message, error) {
+	return []message{c.encode(stdoutChannel, nil)}, nil
+}
+
+func (c channelCodec) encodeOutput(p []byte) message {
+	return c.encode(stdoutChannel, p)
+}
+
+func (c channelCodec) encodeControl(ctl control) (message, bool, error) {
+	switch ctl.Kind {
+	case controlNotice, controlInfo:
+		// shown like Client does, there's no channel for it
+		return c.encode(stdoutChannel, []byte(noticeLine(ctl.Message))), true, nil
+	case controlExit:
+		if ctl.ExitCode == nil {
+			return message{}, false, nil
+		}
+		data, err := c.status(*ctl.ExitCode, ctl.Message)
+		if err != nil || data == nil {
+			return message{}, false, err
+		}
+		return c.encode(errorChannel, data), true, nil
+	default:
+		// e.g. credit, the client doesn't do flow control
+		return message{}, false, nil
+	}
+}
+
+// status returns the error channel payload of an exit status, nil when there's nothing to send.
+func (c channelCodec) status(code int, msg string) ([]byte, error) {
+	if !c.v4 {
+		if code == 0 {
+			return nil, nil
+		}
+		return []byte(msg), nil
+	}
+
+	status := metav1.Status{Status: metav1.StatusSuccess}
+	if code != 0 {
+		status = metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: msg,
+			Reason:  kuberemotecommand.NonZeroExitCodeReason,
+			Details: &metav1.StatusDetails{
+				Causes: []metav1.StatusCause{
+					{Type: kuberemotecommand.ExitCodeCauseType, Message: strconv.Itoa(code)},
+				},
+			},
+		}
+	}
+	return json.Marshal(status)
+}
+
+func (c channelCodec) encode(channel byte, p []byte) message {
+	if c.base64 {
+		data := make([]byte, 1+base64.StdEncoding.EncodedLen(len(p)))
+		data[0] = '0' + channel
+		base64.StdEncoding.Encode(data[1:], p)
+		return message{Type: websocket.TextMessage, Data: data}
+	}
+
+	data := make([]byte, 1+len(p))
+	data[0] = channel
+	copy(data[1:], p)
+	return message{Type: websocket.BinaryMessage, Data: data}
+}
+
+func (c channelCodec) decode(messageType int, data []byte) (frame, error) {
+	if c.base64 && messageType != websocket.TextMessage || !c.base64 && messageType != websocket.BinaryMessage {
+		return frame{}, ErrUnexpectedMessageType
+	}
+	if len(data) == 0 {
+		return frame{}, nil
+	}
+
+	channel, payload := data[0], data[1:]
+	if c.base64 {
+		channel -= '0'
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+		n, err := base64.StdEncoding.Decode(decoded, payload)
+		if err != nil {
+			return frame{}, fmt.Errorf("%w: base64 %s", ErrMalformedMessage, err)
+		}
+		payload = decoded[:n]
+	}
+
+	switch channel {
+	case stdinChannel:
+		if len(payload) == 0 {
+			return frame{}, nil
+		}
+		return frame{input: payload}, nil
+	case resizeChannel:
+		size := remotecommand.TerminalSize{}
+		if err := unmarshalTerminalSize(payload, &size); err != nil {
+			return frame{}, fmt.Errorf("%w: terminal size %s", ErrMalformedMessage, err)
+		}
+		return frame{size: &size}, nil
+	default:
+		return frame{}, nil
+	}
+}
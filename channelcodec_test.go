@@ -0,0 +1,90 @@
+package wsexec
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestChannelCodec(t *testing.T) {
+	testcases := map[string]struct {
+		subprotocol string
+		stdin       []byte
+		resize      []byte
+		expected    []string
+	}{
+		"v4": {
+			subprotocol: SubprotocolV4Channel,
+			stdin:       []byte("\x00ls\r"),
+			resize:      []byte("\x04{\"Width\":100,\"Height\":40}"),
+			expected:    []string{"\x01", "\x01ls\r", "\x01100x40", "\x03{\"metadata\":{},\"status\":\"Failure\",\"message\":\"command terminated with exit code 2\",\"reason\":\"NonZeroExitCode\",\"details\":{\"causes\":[{\"reason\":\"ExitCode\",\"message\":\"2\"}]}}"},
+		},
+		"v4 base64": {
+			subprotocol: SubprotocolV4Base64Channel,
+			stdin:       []byte("0bHMN"),
+			resize:      []byte("4eyJXaWR0aCI6MTAwLCJIZWlnaHQiOjQwfQ=="),
+			expected:    []string{"1", "1bHMN", "1MTAweDQw", "3eyJtZXRhZGF0YSI6e30sInN0YXR1cyI6IkZhaWx1cmUiLCJtZXNzYWdlIjoiY29tbWFuZCB0ZXJtaW5hdGVkIHdpdGggZXhpdCBjb2RlIDIiLCJyZWFzb24iOiJOb25aZXJvRXhpdENvZGUiLCJkZXRhaWxzIjp7ImNhdXNlcyI6W3sicmVhc29uIjoiRXhpdENvZGUiLCJtZXNzYWdlIjoiMiJ9XX19"},
+		},
+		"v1": {
+			subprotocol: SubprotocolChannel,
+			stdin:       []byte("\x00ls\r"),
+			resize:      []byte("\x04{\"Width\":100,\"Height\":40}"),
+			expected:    []string{"\x01", "\x01ls\r", "\x01100x40", "\x03command terminated with exit code 2"},
+		},
+	}
+	for k, tc := range testcases {
+		upgrader := websocket.Upgrader{Subprotocols: KubernetesSubprotocols}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			s := NewServer(conn)
+			go s.Keepalive()
+			// echo a line of input and the terminal size
+			buf := make([]byte, 16)
+			n, _ := s.Read(buf)
+			_, _ = s.Write(buf[:n])
+			if size := s.Next(); size != nil {
+				_, _ = fmt.Fprintf(s, "%dx%d", size.Width, size.Height)
+			}
+			s.Close(&ExitError{Code: 2})
+			<-s.Done()
+		}))
+
+		dialer := websocket.Dialer{Subprotocols: []string{tc.subprotocol}}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", k, err)
+		}
+		if conn.Subprotocol() != tc.subprotocol {
+			t.Errorf("%s: expected subprotocol %s, got %s", k, tc.subprotocol, conn.Subprotocol())
+		}
+		messageType := websocket.BinaryMessage
+		if strings.Contains(tc.subprotocol, "base64") {
+			messageType = websocket.TextMessage
+		}
+		_ = conn.WriteMessage(messageType, tc.stdin)
+		_ = conn.WriteMessage(messageType, tc.resize)
+
+		var got []string
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			got = append(got, string(data))
+		}
+		if strings.Join(got, "|") != strings.Join(tc.expected, "|") {
+			t.Errorf("%s: expected %q, got %q", k, tc.expected, got)
+		}
+		conn.Close()
+		ts.Close()
+	}
+}
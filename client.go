@@ -2,9 +2,11 @@ package wsexec
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 	"github.com/lixianyang/wsexec/term"
@@ -12,12 +14,26 @@ import (
 )
 
 type Client struct {
-	conn       *websocket.Conn
-	errChan    chan error
-	writeChan  chan message
-	tty        term.TTY
-	debugInput io.Writer
-	logger     Logger
+	conn        *websocket.Conn
+	errChan     chan error
+	writeChan   chan message
+	tty         term.TTY
+	debugInput  io.Writer
+	logger      Logger
+	compression compression
+	// outputWindow grants the server output credit, inputWindow is the input credit the server granted
+	outputWindow recvWindow
+	inputWindow  *sendWindow
+	// exitCode is the exit status of the remote process, once the server sent it
+	exitCode atomic.Value
+	// checksum is the checksum control message ending a download
+	checksum atomic.Value
+	// target is the Target the server resolved the session to, once it sent it
+	target   atomic.Value
+	progress func(transferred int64)
+	// inBand takes the output over during in band transfers, see inband.go
+	inBand        *inBandWriter
+	inBandHandler InBandTransferHandler
 }
 
 type ClientOption func(cli *Client)
@@ -40,46 +56,109 @@ func WithClientDebugInput(writer io.Writer) ClientOption {
 	}
 }
 
+// WithClientFlowControl grants the server window bytes of output credit, so the server doesn't send
+// more than window bytes ahead of what the terminal has shown and a slow terminal slows down the
+// remote process. The server must support flow control.
+func WithClientFlowControl(window int) ClientOption {
+	return func(cli *Client) {
+		cli.outputWindow.size = int64(window)
+	}
+}
+
+// WithClientCompression compresses messages of at least threshold bytes with the compress/flate
+// level, when the connection negotiated permessage-deflate, e.g. it was dialed with NewCompressionDialer.
+func WithClientCompression(level, threshold int) ClientOption {
+	return func(cli *Client) {
+		cli.compression = newCompression(level, threshold)
+	}
+}
+
+// WithClientProgress sets a function called with the number of bytes transferred so far as an
+// upload or a download goes.
+func WithClientProgress(fn func(transferred int64)) ClientOption {
+	return func(cli *Client) {
+		cli.progress = fn
+	}
+}
+
+// WithClientInBandTransfer sets the handler of the file transfers remote processes start in the
+// terminal, such as sz and rz, e.g. NewLrzszTransferHandler. Without it they're canceled.
+func WithClientInBandTransfer(handler InBandTransferHandler) ClientOption {
+	return func(cli *Client) {
+		cli.inBandHandler = handler
+	}
+}
+
 func NewClient(conn *websocket.Conn, options ...ClientOption) *Client {
 	in, out, _ := dockerterm.StdStreams()
 	defaultTTY := term.TTY{In: in, Out: out, Raw: true}
 	defaultLogger := discardLogger{}
 
 	client := &Client{
-		conn:      conn,
-		errChan:   make(chan error, 1),
-		writeChan: make(chan message, 1),
-		tty:       defaultTTY,
-		logger:    defaultLogger,
+		conn:        conn,
+		errChan:     make(chan error, 1),
+		writeChan:   make(chan message, 1),
+		tty:         defaultTTY,
+		logger:      defaultLogger,
+		inputWindow: newSendWindow(),
 	}
 
 	for _, opt := range options {
 		opt(client)
 	}
 
+	if err := client.compression.apply(conn); err != nil {
+		client.logger.Println("set compression level err ", err)
+	}
+
 	return client
 }
 
+// Run connects the terminal to the session until it ends, a non-zero exit status of the remote
+// process is returned as an *ExitError.
 func (cli *Client) Run() error {
 	fn := func() error {
 		go cli.send()
+		if cli.outputWindow.size > 0 {
+			if err := cli.grantCredit(cli.outputWindow.size); err != nil {
+				return err
+			}
+		}
 		go cli.monitorTerminalSize()
-		go cli.flushOut(cli.tty.Out)
+		cli.inBand = newInBandWriter(cli, cli.tty.Out)
+		go cli.flushOut(cli.inBand)
 		go cli.scanInput(cli.tty.In)
 
-		err := <-cli.errChan
-		cli.logger.Printfln("received error %s", err)
-		var closeError *websocket.CloseError
-		if errors.As(err, &closeError) {
-			cli.logger.Printfln("silence websocket close error code: %d message: %s", closeError.Code, closeError.Text)
-			err = nil
-		}
-		return err
+		return cli.result(<-cli.errChan)
 	}
 
 	return cli.tty.Safe(fn)
 }
 
+// result returns the outcome of a session that ended with err, see Run.
+func (cli *Client) result(err error) error {
+	cli.logger.Printfln("received error %s", err)
+	var closeError *websocket.CloseError
+	if errors.As(err, &closeError) {
+		cli.logger.Printfln("silence websocket close error code: %d message: %s", closeError.Code, closeError.Text)
+		if closeError.Code != websocket.CloseNormalClosure && closeError.Text != "" {
+			cli.showNotice(closeError.Text)
+		}
+		err = nil
+	}
+	if code, ok := cli.exitCode.Load().(int); ok && code != 0 && err == nil {
+		err = &ExitError{Code: code}
+	}
+	return err
+}
+
+// Target returns the target the server resolved the session to, such as the pod picked for a
+// deployment, false until the server sent it. Command and Port aren't sent.
+func (cli *Client) Target() (Target, bool) {
+	target, ok := cli.target.Load().(Target)
+	return target, ok
+}
+
 // monitor terminal size, and send change size command
 func (cli *Client) monitorTerminalSize() {
 	sizeQueue := cli.tty.MonitorSize(cli.tty.GetSize())
@@ -114,18 +193,74 @@ func (cli *Client) flushOut(writer io.Writer) {
 	cli.logger.Println("output flush goroutine start")
 
 	for {
-		_, reader, err := cli.conn.NextReader()
+		t, reader, err := cli.conn.NextReader()
 		if err != nil {
 			cli.logger.Println("output flush goroutine returned with next reader err ", err)
 			cli.errChan <- fmt.Errorf("read data from connection %w", err)
 			return
 		}
-		if _, err = io.Copy(writer, reader); err != nil {
+		if isControlType(t) {
+			if err = cli.handleControl(reader); err != nil {
+				cli.logger.Println("output flush goroutine returned with handle control err ", err)
+				cli.errChan <- fmt.Errorf("handle control message %w", err)
+				return
+			}
+			continue
+		}
+		n, err := io.Copy(writer, reader)
+		if err != nil {
 			cli.logger.Println("output flush goroutine returned with io copy err ", err)
 			cli.errChan <- fmt.Errorf("copy data from connection to output %w", err)
 			return
 		}
+		if credit := cli.outputWindow.consume(int(n)); credit > 0 {
+			if err = cli.grantCredit(credit); err != nil {
+				cli.logger.Println("output flush goroutine returned with grant credit err ", err)
+				cli.errChan <- fmt.Errorf("grant output credit %w", err)
+				return
+			}
+		}
+	}
+}
+
+func (cli *Client) handleControl(reader io.Reader) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	c := control{}
+	if err = unmarshalControl(data, &c); err != nil {
+		return err
+	}
+
+	cli.logger.Printfln("received control message %s", string(data))
+	switch c.Kind {
+	case controlNotice:
+		cli.showNotice(c.Message)
+	case controlInfo:
+		cli.target.Store(Target{Namespace: c.Namespace, Pod: c.Pod, Container: c.Container})
+		cli.showNotice(c.Message)
+	case controlCredit:
+		cli.inputWindow.grant(c.Credit)
+	case controlExit:
+		if c.ExitCode != nil {
+			cli.exitCode.Store(*c.ExitCode)
+		}
+	case controlChecksum:
+		cli.checksum.Store(c)
+	default:
+		cli.logger.Printfln("ignore unknown control message kind %s", c.Kind)
 	}
+	return nil
+}
+
+// showNotice prints message on its own line.
+func (cli *Client) showNotice(message string) {
+	if cli.tty.Out == nil {
+		return
+	}
+	_, _ = io.WriteString(cli.tty.Out, noticeLine(message))
 }
 
 func (cli *Client) send() {
@@ -133,6 +268,7 @@ func (cli *Client) send() {
 
 	var err error
 	for msg := range cli.writeChan {
+		cli.compression.beforeWrite(cli.conn, len(msg.Data))
 		if err = cli.conn.WriteMessage(int(msg.Type), msg.Data); err != nil {
 			cli.logger.Println("send goroutine returned with write message err ", err)
 			cli.errChan <- fmt.Errorf("write data to connection %w", err)
@@ -171,9 +307,30 @@ func (cli *Client) scanInput(reader io.Reader) {
 			}
 		}
 
+		if cli.inBand != nil && cli.inBand.intercept(bytes) {
+			continue
+		}
 		cli.recordInput(bytes)
-		cli.writeChan <- newDataMessage(bytes)
+		cli.sendData(bytes)
+	}
+}
+
+// sendData queues data for the send goroutine within the input credit granted by the server.
+func (cli *Client) sendData(data []byte) {
+	for len(data) > 0 {
+		n, _ := cli.inputWindow.acquire(context.Background(), len(data))
+		cli.writeChan <- newDataMessage(data[:n])
+		data = data[n:]
+	}
+}
+
+func (cli *Client) grantCredit(credit int64) error {
+	data, err := marshalControl(control{Kind: controlCredit, Credit: credit})
+	if err != nil {
+		return err
 	}
+	cli.writeChan <- newControlMessage(data)
+	return nil
 }
 
 func (cli *Client) recordInput(data []byte) {
@@ -0,0 +1,84 @@
+package wsexec
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// codec translates between the messages of a wire protocol and a session, the protocol is chosen
+// by the websocket subprotocol the client negotiated, see codecFor.
+type codec interface {
+	// greeting returns the messages sent when the session starts.
+	greeting() ([]message, error)
+	// encodeOutput returns the message carrying output of the remote process.
+	encodeOutput(p []byte) message
+	// encodeControl returns the message carrying c, ok is false when the protocol can't carry it.
+	encodeControl(c control) (m message, ok bool, err error)
+	// decode returns what a message of the client carries.
+	decode(messageType int, data []byte) (frame, error)
+}
+
+// frame is what a message of the client carries, a frame carrying nothing is ignored.
+type frame struct {
+	input   []byte
+	size    *remotecommand.TerminalSize
+	control *control
+	// reply is sent back right away, e.g. a pong
+	reply *message
+}
+
+// codecFor returns the codec of subprotocol, the wsexec protocol when it's unknown or empty.
+func codecFor(subprotocol string) codec {
+	switch subprotocol {
+	case SubprotocolChannel, SubprotocolBase64Channel, SubprotocolV4Channel, SubprotocolV4Base64Channel:
+		return newChannelCodec(subprotocol)
+	case SubprotocolTTYD:
+		return ttydCodec{}
+	case SubprotocolGotty, SubprotocolGottyV1:
+		return newGottyCodec(subprotocol)
+	default:
+		return wsexecCodec{}
+	}
+}
+
+// wsexecCodec is the protocol of Client and wsexec.js: output and input are binary messages,
+// control messages and terminal size changes are JSON text messages.
+type wsexecCodec struct{}
+
+func (wsexecCodec) greeting() ([]message, error) {
+	return nil, nil
+}
+
+func (wsexecCodec) encodeOutput(p []byte) message {
+	return newDataMessage(p)
+}
+
+func (wsexecCodec) encodeControl(c control) (message, bool, error) {
+	data, err := marshalControl(c)
+	if err != nil {
+		return message{}, false, err
+	}
+	return newControlMessage(data), true, nil
+}
+
+func (wsexecCodec) decode(messageType int, data []byte) (frame, error) {
+	switch {
+	case isDataType(messageType):
+		return frame{input: data}, nil
+	case isControlType(messageType):
+		c := control{}
+		if err := unmarshalControl(data, &c); err == nil && c.Kind != "" {
+			return frame{control: &c}, nil
+		}
+
+		// a terminal size change from clients predating control messages
+		size := remotecommand.TerminalSize{}
+		if err := unmarshalTerminalSize(data, &size); err != nil {
+			return frame{}, fmt.Errorf("%w: terminal size %s", ErrMalformedMessage, err)
+		}
+		return frame{size: &size}, nil
+	default:
+		return frame{}, ErrUnexpectedMessageType
+	}
+}
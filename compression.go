@@ -0,0 +1,47 @@
+package wsexec
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// DefaultCompressionThreshold is the message size in bytes below which compressing isn't worth it,
+// such as single keystrokes and short echoes.
+const DefaultCompressionThreshold = 256
+
+// compression decides which messages are compressed once permessage-deflate has been negotiated.
+type compression struct {
+	enabled   bool
+	level     int
+	threshold int
+}
+
+// apply sets the compression level of conn, it has no effect unless the extension was negotiated.
+func (c compression) apply(conn *websocket.Conn) error {
+	if !c.enabled {
+		return nil
+	}
+	return conn.SetCompressionLevel(c.level)
+}
+
+// beforeWrite enables compression of the next message on conn if it's large enough, the caller
+// must be the only writer of conn.
+func (c compression) beforeWrite(conn *websocket.Conn, size int) {
+	if c.enabled {
+		conn.EnableWriteCompression(size >= c.threshold)
+	}
+}
+
+func newCompression(level, threshold int) compression {
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	return compression{enabled: true, level: level, threshold: threshold}
+}
+
+// NewCompressionDialer returns a copy of websocket.DefaultDialer that negotiates permessage-deflate,
+// use it along with WithClientCompression.
+func NewCompressionDialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	return &dialer
+}
@@ -0,0 +1,126 @@
+package wsexec
+
+import (
+	"compress/flate"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// terminalOutput returns output typical of a session: a table, a manifest and colored logs.
+func terminalOutput() [][]byte {
+	var table strings.Builder
+	table.WriteString("NAME                                READY   STATUS    RESTARTS   AGE\r\n")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&table, "web-frontend-7d9c8b6f4-%05d        1/1     Running   0          %dd\r\n", i*7919%100000, i%30)
+	}
+
+	var manifest strings.Builder
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&manifest, "  - name: container-%d\r\n    image: registry.example.com/team/app:v1.%d.0\r\n"+
+			"    ports:\r\n    - containerPort: %d\r\n      protocol: TCP\r\n"+
+			"    resources:\r\n      limits:\r\n        cpu: 500m\r\n        memory: 512Mi\r\n", i, i, 8080+i)
+	}
+
+	var logs strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&logs, "\x1b[32m2021-03-%02dT10:%02d:%02d.%03dZ\x1b[0m \x1b[1mINFO\x1b[0m request handled method=GET path=/api/v1/items/%d status=200 duration=%dms\r\n",
+			i%28+1, i%60, i*13%60, i*37%1000, i, i*3%250)
+	}
+
+	return [][]byte{
+		[]byte("l"), []byte("s"), []byte("\r\n"), []byte("\x1b[?2004h$ "),
+		[]byte(table.String()), []byte(manifest.String()), []byte(logs.String()),
+	}
+}
+
+// countingConn counts the bytes read from the wire.
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func benchmarkCompression(b *testing.B, options ...ServerOption) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		s := NewServer(conn, options...)
+		output := terminalOutput()
+		for i := 0; i < b.N; i++ {
+			for _, p := range output {
+				if _, err := s.Write(p); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}
+	}))
+	defer ts.Close()
+
+	var read int64
+	dialer := NewCompressionDialer()
+	// a negotiated connection compresses every message by default
+	dialer.EnableCompression = len(options) > 0
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		return countingConn{Conn: conn, read: &read}, err
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	var size int
+	output := terminalOutput()
+	for _, p := range output {
+		size += len(p)
+	}
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N*len(output); i++ {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	wire := float64(atomic.LoadInt64(&read)) / float64(b.N)
+	b.ReportMetric(wire, "wire-B/op")
+	b.ReportMetric(float64(size)/wire, "ratio")
+}
+
+func BenchmarkCompression(b *testing.B) {
+	benchmarks := map[string][]ServerOption{
+		"disabled":             nil,
+		"best speed":           {WithServerCompression(flate.BestSpeed, 0)},
+		"default":              {WithServerCompression(flate.DefaultCompression, 0)},
+		"best compression":     {WithServerCompression(flate.BestCompression, 0)},
+		"best speed every msg": {WithServerCompression(flate.BestSpeed, 1)},
+		"huffman only":         {WithServerCompression(flate.HuffmanOnly, 0)},
+	}
+	for k, options := range benchmarks {
+		b.Run(k, func(b *testing.B) {
+			benchmarkCompression(b, options...)
+		})
+	}
+}
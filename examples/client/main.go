@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"compress/flate"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/lixianyang/wsexec"
@@ -12,31 +23,174 @@ import (
 
 func main() {
 	namespace := "default"
+	// or deploy/name, svc/name, sts/name or a label selector, the server tells which pod it picked
 	pod := "your-pod-name"
+	// empty starts the first of bash, ash and sh the image has
 	command := "your-command"
 	query := url.Values{}
 	query.Set("namespace", namespace)
 	query.Set("pod", pod)
 	query.Set("command", command)
+	// "upload local-path... remote-dir" and "download remote-path local-dir" copy files instead,
+	// "forward local-port remote-port" forwards the connections to local-port to remote-port of the pod
+	// and "logs" follows the last 100 lines of the pod logs, while "fanout selector command args..."
+	// runs a command on every pod matching the label selector and "broadcast selector shell" types in
+	// the shells of every pod matching it at once, and "debug image command" runs the command in a debug
+	// container of the image for pods without a shell
+	var transfer wsexec.TransferDirection
+	var local []string
+	var forward string
+	logs := len(os.Args) == 2 && os.Args[1] == "logs"
+	if len(os.Args) > 3 && os.Args[1] == "fanout" {
+		// the output is shown like logs
+		logs = true
+		query.Set("selector", os.Args[2])
+		query["command"] = os.Args[3:]
+		query.Set("color", "true")
+	} else if len(os.Args) > 3 && os.Args[1] == "broadcast" {
+		query.Set("selector", os.Args[2])
+		query["command"] = os.Args[3:]
+		query.Set("broadcast", "true")
+	} else if len(os.Args) == 4 && os.Args[1] == "debug" {
+		query.Set("debug", os.Args[2])
+		query.Set("command", os.Args[3])
+	} else if logs {
+		query.Set("logs", "true")
+		query.Set("follow", "true")
+		query.Set("tailLines", "100")
+	} else if len(os.Args) == 4 && os.Args[1] == "forward" {
+		forward = "127.0.0.1:" + os.Args[2]
+		query.Set("port", os.Args[3])
+	} else if len(os.Args) > 3 {
+		transfer = wsexec.TransferDirection(os.Args[1])
+		switch transfer {
+		case wsexec.TransferUpload:
+			local = os.Args[2 : len(os.Args)-1]
+			query.Set("path", os.Args[len(os.Args)-1])
+		case wsexec.TransferDownload:
+			local = os.Args[3:4]
+			query.Set("path", os.Args[2])
+		}
+		query.Set("transfer", string(transfer))
+	}
 	u, _ := url.Parse("ws://127.0.0.1:8080/exec")
-	u.RawQuery = query.Encode()
 
 	headers := http.Header{}
+	if token := os.Getenv("WSEXEC_TOKEN"); token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
 
-	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), headers)
-	if err != nil {
-		fmt.Println(err)
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
+	var conn *websocket.Conn
+	for {
+		u.RawQuery = query.Encode()
+		c, resp, err := wsexec.NewCompressionDialer().Dial(u.String(), headers)
+		if err == nil {
+			conn = c
+			break
+		}
+		if resp == nil {
 			panic(err)
-		} else {
-			fmt.Println(resp.StatusCode, ":", string(body))
 		}
+		body, readErr := io.ReadAll(resp.Body)
+		if readErr != nil {
+			panic(readErr)
+		}
+		// the pod has several containers, the user picks one and it's dialed again
+		choice := &wsexec.ContainerChoiceError{}
+		if json.Unmarshal(body, choice) == nil && len(choice.Containers) > 0 {
+			container, err := pickContainer(choice)
+			if err != nil {
+				panic(err)
+			}
+			query.Set("container", container)
+			continue
+		}
+		fmt.Println(err)
+		fmt.Println(resp.StatusCode, ":", string(body))
 		return
 	}
 
-	client := wsexec.NewClient(conn)
-	if err = client.Run(); err != nil {
+	var err error
+	client := wsexec.NewClient(conn,
+		wsexec.WithClientFlowControl(256*1024),
+		wsexec.WithClientCompression(flate.BestSpeed, wsexec.DefaultCompressionThreshold),
+		wsexec.WithClientProgress(func(transferred int64) {
+			fmt.Fprintf(os.Stderr, "\r%d bytes", transferred)
+		}),
+		// sz in the shell downloads into the current directory, rz uploads the files of WSEXEC_RZ_FILES
+		wsexec.WithClientInBandTransfer(wsexec.NewLrzszTransferHandler(".", func() ([]string, error) {
+			return filepath.SplitList(os.Getenv("WSEXEC_RZ_FILES")), nil
+		})),
+	)
+	switch {
+	case forward != "":
+		err = runForward(client, forward)
+	case logs:
+		err = runLogs(client, conn)
+	case transfer == wsexec.TransferUpload:
+		err = client.Upload(local...)
+	case transfer == wsexec.TransferDownload:
+		err = client.Download(local[0])
+	default:
+		err = client.Run()
+	}
+	if err != nil {
+		var exitErr *wsexec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		panic(err)
 	}
 }
+
+// runForward forwards the connections to address until ctrl-c.
+func runForward(client *wsexec.Client, address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		<-signals
+		// closing the listener ends the session
+		_ = l.Close()
+	}()
+
+	fmt.Println("forwarding from", l.Addr())
+	return client.Forward(l)
+}
+
+// runLogs follows the logs until ctrl-c.
+func runLogs(client *wsexec.Client, conn *websocket.Conn) error {
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		<-signals
+		// the server ends the session once the client closed it
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		_ = conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	}()
+
+	return client.Logs()
+}
+
+// pickContainer asks the user which of the containers of choice to use.
+func pickContainer(choice *wsexec.ContainerChoiceError) (string, error) {
+	fmt.Printf("pod %s has several containers:\n", choice.Pod)
+	for i, name := range choice.Containers {
+		fmt.Printf("  %d) %s\n", i+1, name)
+	}
+	input := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("container [1-%d]: ", len(choice.Containers))
+		line, err := input.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line))
+		if n >= 1 && n <= len(choice.Containers) {
+			return choice.Containers[n-1], nil
+		}
+	}
+}
@@ -1,27 +1,36 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
+	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/lixianyang/wsexec"
+	"github.com/lixianyang/wsexec/kube"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/remotecommand"
 )
 
 var (
 	restConfig *rest.Config
-	restClient *rest.RESTClient
-	clientSet  *kubernetes.Clientset
+	executor   *kube.Executor
+	sessions   *wsexec.SessionManager
+	containers *kube.ContainerSelector
+	shells     = kube.DefaultShells
 )
 
 func init() {
@@ -35,28 +44,28 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-
-	config.APIPath = "/api"
-	config.GroupVersion = &corev1.SchemeGroupVersion
-	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
-
-	restClient, err = rest.RESTClientFor(config)
-	if err != nil {
-		panic(err)
-	}
-	clientSet, err = kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err)
-	}
 	restConfig = config
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	r, err := sessions.Authenticate(w, r)
+	if err != nil {
+		fmt.Println("authenticate returned with ", err)
+		return
+	}
+
 	q := r.URL.Query()
 	namespace := q.Get("namespace")
 	if namespace == "" {
 		namespace = "default"
 	}
+	// selector=app%3Dweb runs the command on every running pod matching the label selector instead
+	if selector := q.Get("selector"); selector != "" {
+		fanOut(w, r, namespace, selector)
+		return
+	}
+	// pod=deploy/web, svc/web, sts/web or app%3Dweb picks a ready pod of the workload with strategy
+	// random, first or least-loaded, instead of naming the pod
 	podName := q.Get("pod")
 	if podName == "" {
 		w.WriteHeader(400)
@@ -64,18 +73,55 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	containerName := q.Get("container")
-	command := q.Get("command")
-	if command == "" {
+	// transfer=upload&path=/dir extracts an upload into /dir, transfer=download&path=/file archives /file
+	transfer := wsexec.TransferDirection(q.Get("transfer"))
+	// port=6060 forwards the connections the client accepts to port 6060 of the pod
+	port, _ := strconv.Atoi(q.Get("port"))
+	// debug=busybox runs the command in an ephemeral container of that image, sharing the processes of
+	// the container, for images without a shell
+	debugImage := q.Get("debug")
+	// logs=true streams the container logs instead, with follow, tailLines and sinceTime (RFC 3339)
+	logs, err := logOptions(q)
+	if err != nil {
 		w.WriteHeader(400)
-		fmt.Fprint(w, "miss command query parameter")
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	var command []string
+	// without command the first shell of the image in shells is started
+	defaultShell := false
+	switch transfer {
+	case wsexec.TransferUpload:
+		command = kube.UploadCommand(q.Get("path"))
+	case wsexec.TransferDownload:
+		command = kube.DownloadCommand(q.Get("path"))
+	default:
+		if port != 0 || logs != nil {
+			break
+		}
+		if q.Get("command") == "" {
+			// a debug container runs the entrypoint of its image
+			defaultShell = debugImage == ""
+			break
+		}
+		command = []string{q.Get("command")}
+	}
+	if transfer != "" && q.Get("path") == "" {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "miss path query parameter")
 		return
 	}
 
-	pod, err := clientSet.CoreV1().Pods(namespace).Get(r.Context(), podName, metav1.GetOptions{})
+	// with impersonation the pod is read with the user's permissions as well
+	pod, err := executor.Resolve(r.Context(), namespace, podName, kube.Strategy(q.Get("strategy")))
 	if err != nil {
 		if errors.IsNotFound(err) {
 			w.WriteHeader(400)
-			fmt.Fprintf(w, "can't found pod %s", podName)
+			fmt.Fprintf(w, "can't found %s", podName)
+			return
+		} else if stderrors.Is(err, kube.ErrNoReadyPod) || stderrors.Is(err, kube.ErrUnknownWorkload) || stderrors.Is(err, kube.ErrUnknownStrategy) {
+			w.WriteHeader(400)
+			fmt.Fprint(w, err.Error())
 			return
 		} else {
 			w.WriteHeader(500)
@@ -83,60 +129,94 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	if pod.Status.Phase != corev1.PodRunning {
+	// the client learns which pod it got
+	resolved := pod.Name != podName
+	// the logs of a crashing container are worth reading
+	if pod.Status.Phase != corev1.PodRunning && logs == nil {
 		w.WriteHeader(400)
 		fmt.Fprintf(w, "only running pod can exec, pod %s in %s phase now", pod.Name, pod.Status.Phase)
 		return
 	}
 	if containerName == "" {
-		containerName, err = getContainerNameForExec(pod)
-		if err != nil {
+		containerName, err = containers.Select(pod)
+		var choiceErr *wsexec.ContainerChoiceError
+		if stderrors.As(err, &choiceErr) {
+			// the client may let the user pick one and retry with container
+			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(400)
-			fmt.Fprint(w, err.Error())
+			_ = json.NewEncoder(w).Encode(choiceErr)
 			return
 		}
 	}
 
-	req := restClient.Post().
-		Namespace(namespace).
-		Resource("pods").
-		Name(podName).
-		SubResource("exec")
-	execOption := &corev1.PodExecOptions{
-		Stdin:     true,
-		Stdout:    true,
-		Stderr:    true,
-		TTY:       true,
-		Container: containerName,
-		Command:   []string{command},
+	target := wsexec.Target{Namespace: namespace, Pod: pod.Name, Container: containerName, Command: command, Port: port, Logs: logs != nil, Image: debugImage}
+	if defaultShell {
+		// the probe and the shell command of every shell must be allowed, as any of them may run
+		for _, shell := range shells {
+			for _, command := range [][]string{kube.ShellProbeCommand(shell), kube.ShellCommand(shell)} {
+				target.Command = command
+				if r, err = sessions.Authorize(w, r, target); err != nil {
+					fmt.Println("authorize returned with ", err)
+					return
+				}
+			}
+		}
+	} else if r, err = sessions.Authorize(w, r, target); err != nil {
+		fmt.Println("authorize returned with ", err)
+		return
 	}
-	req.VersionedParams(execOption, scheme.ParameterCodec)
-	exec, err := remotecommand.NewSPDYExecutor(restConfig, "POST", req.URL())
+
+	s, err := sessions.Upgrade(w, r, nil)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "can't upgrade to spdy %s", err)
+		fmt.Println("upgrade returned with ", err)
 		return
 	}
+	go s.Keepalive()
+	if resolved {
+		if err = s.Info(target); err != nil {
+			fmt.Println("send info returned with ", err)
+		}
+	}
 
-	upgrader := websocket.Upgrader{}
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "can't upgrade to websocket %s", err)
+	if logs != nil {
+		if err = executor.Logs(s, target, *logs); err != nil {
+			fmt.Println("logs returned with ", err)
+		}
+		s.Close(err)
 		return
 	}
 
-	s := wsexec.NewServer(conn)
-	go s.Keepalive()
+	if port != 0 {
+		if err = executor.Forward(s, target); err != nil {
+			fmt.Println("forward returned with ", err)
+		}
+		s.Close(err)
+		return
+	}
 
-	streamOption := remotecommand.StreamOptions{
-		Stdin:             s,
-		Stdout:            s,
-		Stderr:            s,
-		Tty:               true,
-		TerminalSizeQueue: s,
+	if debugImage != "" {
+		if err = executor.Debug(s, target, debugImage); err != nil {
+			fmt.Println("debug returned with ", err)
+		}
+		s.Close(err)
+		return
+	}
+
+	if transfer != "" {
+		t := wsexec.NewTransfer(s, transfer)
+		if err = executor.Transfer(t, target); err != nil {
+			fmt.Println("transfer returned with ", err)
+		}
+		t.Close(err)
+		return
 	}
-	if err = exec.Stream(streamOption); err != nil {
+
+	if defaultShell {
+		err = executor.Shell(s, target)
+	} else {
+		err = executor.Exec(s, target)
+	}
+	if err != nil {
 		fmt.Println("stream returned with ", err)
 	}
 
@@ -144,33 +224,168 @@ func handler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	var options []wsexec.SessionManagerOption
+	// set WSEXEC_TOKEN to require "Authorization: Bearer $WSEXEC_TOKEN" or "?access_token=$WSEXEC_TOKEN"
+	if token := os.Getenv("WSEXEC_TOKEN"); token != "" {
+		tokens := map[string]wsexec.Identity{token: {User: "example"}}
+		options = append(options, wsexec.WithSessionManagerAuthenticator(wsexec.NewStaticTokenAuthenticator(tokens)))
+	}
+	// set WSEXEC_POLICY to the path of a rule file to restrict who can exec what
+	if path := os.Getenv("WSEXEC_POLICY"); path != "" {
+		authorizer, err := wsexec.LoadRuleAuthorizer(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options = append(options, wsexec.WithSessionManagerAuthorizer(authorizer))
+	}
+	// set WSEXEC_ALLOWED_ORIGINS to comma separated origins of web consoles served from other hosts
+	if origins := os.Getenv("WSEXEC_ALLOWED_ORIGINS"); origins != "" {
+		options = append(options, wsexec.WithSessionManagerAllowedOrigins(strings.Split(origins, ",")...))
+	}
+	options = append(options, wsexec.WithSessionManagerAuditLogger(wsexec.NewLogger(os.Stdout)))
+	// frontends of the apiserver exec, such as dashboards, can connect unchanged
+	options = append(options, wsexec.WithSessionManagerSubprotocols(wsexec.KubernetesSubprotocols...))
+	// and so can the ttyd and gotty frontends, given a websocket url carrying the target
+	options = append(options, wsexec.WithSessionManagerSubprotocols(wsexec.SubprotocolTTYD, wsexec.SubprotocolGotty, wsexec.SubprotocolGottyV1))
+	options = append(options, wsexec.WithSessionManagerCompression(flate.BestSpeed, wsexec.DefaultCompressionThreshold))
+	options = append(options, wsexec.WithSessionManagerServerOptions(
+		wsexec.WithServerFlowControl(64*1024),
+		wsexec.WithServerWriteTimeout(30*time.Second),
+	))
+	sessions = wsexec.NewSessionManager(options...)
+
+	var executorOptions []kube.ExecutorOption
+	// set WSEXEC_IMPERSONATE along with WSEXEC_TOKEN to exec as the authenticated user
+	if os.Getenv("WSEXEC_IMPERSONATE") != "" {
+		executorOptions = append(executorOptions, kube.WithExecutorImpersonation())
+	}
+	// WSEXEC_SIDECARS replaces the sidecars skipped when picking the container, e.g. istio-proxy,fluent-bit
+	var containerOptions []kube.ContainerSelectorOption
+	if sidecars := os.Getenv("WSEXEC_SIDECARS"); sidecars != "" {
+		containerOptions = append(containerOptions, kube.WithContainerSelectorSidecars(strings.Split(sidecars, ",")...))
+	}
+	containers = kube.NewContainerSelector(containerOptions...)
+	// WSEXEC_SHELLS replaces the shells tried without command, e.g. zsh,bash,sh
+	if names := os.Getenv("WSEXEC_SHELLS"); names != "" {
+		shells = strings.Split(names, ",")
+	}
+	executorOptions = append(executorOptions, kube.WithExecutorShells(shells...))
+	var err error
+	if executor, err = kube.NewExecutor(restConfig, executorOptions...); err != nil {
+		log.Fatal(err)
+	}
+
 	http.HandleFunc("/exec", handler)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// open http://127.0.0.1:8080/terminal/?pod=your-pod-name in a browser for a shell
+	http.Handle("/terminal/", wsexec.NewWebHandler())
+	server := &http.Server{Addr: ":8080"}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		// hijacked websocket connections aren't tracked by http.Server, drain them first
+		if err := sessions.Shutdown(ctx); err != nil {
+			log.Println("sessions shutdown returned with ", err)
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("http server shutdown returned with ", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
-func getContainerNameForExec(pod *corev1.Pod) (name string, err error) {
-	containers := make(map[string]bool)
-	names := make([]string, 0)
-	for _, c := range pod.Spec.Containers {
-		containers[c.Name] = true
-		names = append(names, c.Name)
-	}
-	const sideCarContainerName = "istio-proxy"
-	switch len(containers) {
-	case 1:
-		name = names[0]
-	case 2:
-		if containers[sideCarContainerName] {
-			if names[0] == sideCarContainerName {
-				name = names[1]
-			} else {
-				name = names[0]
-			}
-		} else {
-			err = fmt.Errorf("a container name must be specified for pod %s, choose one of: [%s]", pod.Name, strings.Join(names, " "))
+// fanOut runs the command, whose arguments are repeated command query parameters, on the pods matching
+// selector with parallelism pods at a time and color=true coloring their names. broadcast=true runs it
+// with a tty instead, with the input going to every pod, e.g. command=bash to type in several shells.
+func fanOut(w http.ResponseWriter, r *http.Request, namespace, selector string) {
+	q := r.URL.Query()
+	command := q["command"]
+	if len(command) == 0 {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "miss command query parameter")
+		return
+	}
+	// the container of each pod is picked like for a single pod, so that rules on containers apply
+	targets, err := executor.SelectTargets(r.Context(), namespace, selector, containers, q.Get("container"), command)
+	var choiceErr *wsexec.ContainerChoiceError
+	if stderrors.As(err, &choiceErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		_ = json.NewEncoder(w).Encode(choiceErr)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "list pods error %s", err)
+		return
+	}
+	if len(targets) == 0 {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "no running pod matches %s", selector)
+		return
+	}
+	// every pod must be allowed, the session is audited with the last one
+	for _, target := range targets {
+		if r, err = sessions.Authorize(w, r, target); err != nil {
+			fmt.Println("authorize returned with ", err)
+			return
 		}
-	default:
-		err = fmt.Errorf("a container name must be specified for pod %s, choose one of: [%s]", pod.Name, strings.Join(names, " "))
 	}
-	return
+
+	broadcast, _ := strconv.ParseBool(q.Get("broadcast"))
+	var options []wsexec.FanOutOption
+	if parallelism, err := strconv.Atoi(q.Get("parallelism")); err == nil {
+		options = append(options, wsexec.WithFanOutParallelism(parallelism))
+	}
+	if color, _ := strconv.ParseBool(q.Get("color")); color {
+		options = append(options, wsexec.WithFanOutColor())
+	}
+
+	s, err := sessions.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Println("upgrade returned with ", err)
+		return
+	}
+	go s.Keepalive()
+
+	if broadcast {
+		err = executor.Broadcast(s, targets)
+	} else {
+		err = executor.FanOut(s, targets, options...)
+	}
+	if err != nil {
+		fmt.Println("fan out returned with ", err)
+	}
+	s.Close(err)
+}
+
+// logOptions returns the log options of the query, nil unless it asks for logs.
+func logOptions(q url.Values) (*corev1.PodLogOptions, error) {
+	if logs, _ := strconv.ParseBool(q.Get("logs")); !logs {
+		return nil, nil
+	}
+
+	options := &corev1.PodLogOptions{}
+	options.Follow, _ = strconv.ParseBool(q.Get("follow"))
+	if tailLines := q.Get("tailLines"); tailLines != "" {
+		lines, err := strconv.ParseInt(tailLines, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tailLines query parameter %w", err)
+		}
+		options.TailLines = &lines
+	}
+	if sinceTime := q.Get("sinceTime"); sinceTime != "" {
+		since, err := time.Parse(time.RFC3339, sinceTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sinceTime query parameter %w", err)
+		}
+		options.SinceTime = &metav1.Time{Time: since}
+	}
+	return options, nil
 }
@@ -0,0 +1,210 @@
+package wsexec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+)
+
+// fanOutColors are the ANSI colors of the pod name prefixes, they repeat after the sixth pod.
+var fanOutColors = []string{"\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m", "\x1b[31m"}
+
+// FanOut runs a command on several targets for a single session, such as every replica of a
+// deployment. Every line of output is prefixed with the pod it comes from, and a table of the
+// exit codes follows once the command finished everywhere.
+type FanOut struct {
+	parallelism int
+	color       bool
+}
+
+type FanOutOption func(f *FanOut)
+
+// WithFanOutParallelism sets how many targets run the command at once, 10 by default.
+func WithFanOutParallelism(n int) FanOutOption {
+	return func(f *FanOut) {
+		f.parallelism = n
+	}
+}
+
+// WithFanOutColor colors the pod name prefixes, so the output of each pod stands out.
+func WithFanOutColor() FanOutOption {
+	return func(f *FanOut) {
+		f.color = true
+	}
+}
+
+func NewFanOut(options ...FanOutOption) *FanOut {
+	defaultParallelism := 10
+
+	f := &FanOut{
+		parallelism: defaultParallelism,
+	}
+
+	for _, opt := range options {
+		opt(f)
+	}
+
+	if f.parallelism < 1 {
+		f.parallelism = 1
+	}
+
+	return f
+}
+
+// FanOutResult is how the command ended on a target.
+type FanOutResult struct {
+	Target Target
+	// ExitCode is -1 when the command didn't exit, e.g. the pod was gone, see Err
+	ExitCode int
+	Err      error
+}
+
+// FanOutError is returned by FanOut.Run when the command failed on some of the targets, its exit
+// status is 1 so the client sees the fan out failed.
+type FanOutError struct {
+	Failed int
+	Total  int
+}
+
+func (e *FanOutError) Error() string {
+	return fmt.Sprintf("command failed on %d of %d pods", e.Failed, e.Total)
+}
+
+func (e *FanOutError) ExitStatus() int {
+	return 1
+}
+
+// ExecFunc runs the command of target with its output going to stdout and stderr.
+type ExecFunc func(ctx context.Context, target Target, stdout, stderr io.Writer) error
+
+// Run runs exec for every target and writes their prefixed output to w, then the table of exit codes.
+// Once ctx is done no more targets are started. It returns a *FanOutError unless every command exited with 0.
+func (f *FanOut) Run(ctx context.Context, w io.Writer, targets []Target, exec ExecFunc) error {
+	width := 0
+	for _, target := range targets {
+		if len(target.Pod) > width {
+			width = len(target.Pod)
+		}
+	}
+
+	var mu sync.Mutex
+	results := make([]FanOutResult, len(targets))
+	sem := make(chan struct{}, f.parallelism)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = FanOutResult{Target: target, ExitCode: -1, Err: ctx.Err()}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			prefix := fmt.Sprintf("%-*s | ", width, target.Pod)
+			if f.color {
+				prefix = fanOutColors[i%len(fanOutColors)] + prefix + "\x1b[0m"
+			}
+			stdout := &prefixWriter{mu: &mu, w: w, prefix: prefix}
+			stderr := &prefixWriter{mu: &mu, w: w, prefix: prefix}
+			err := exec(ctx, target, stdout, stderr)
+			stdout.flush()
+			stderr.flush()
+
+			code, ok := exitStatus(err)
+			if !ok {
+				code = -1
+			}
+			results[i] = FanOutResult{Target: target, ExitCode: code, Err: err}
+		}(i, target)
+	}
+	wg.Wait()
+
+	return writeFanOutSummary(w, results)
+}
+
+// writeFanOutSummary writes the table of exit codes.
+func writeFanOutSummary(w io.Writer, results []FanOutResult) error {
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nPOD\tEXIT CODE\tERROR")
+	failed := 0
+	for _, r := range results {
+		code := fmt.Sprint(r.ExitCode)
+		if r.ExitCode < 0 {
+			code = "-"
+		}
+		msg := ""
+		if r.Err != nil {
+			msg = r.Err.Error()
+		}
+		if r.ExitCode != 0 {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Target.Pod, code, msg)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return &FanOutError{Failed: failed, Total: len(results)}
+	}
+	return nil
+}
+
+// prefixWriter writes whole lines prefixed with the pod name, so lines of different pods never mix.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	// partial is the end of the output without a line feed yet
+	partial []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.partial = append(p.partial, data...)
+	i := bytes.LastIndexByte(p.partial, '\n')
+	if i < 0 {
+		return len(data), nil
+	}
+
+	lines := p.partial[:i+1]
+	if err := p.write(lines); err != nil {
+		return 0, err
+	}
+	p.partial = append(p.partial[:0], p.partial[i+1:]...)
+	return len(data), nil
+}
+
+// flush writes the last line even though it doesn't end with a line feed.
+func (p *prefixWriter) flush() {
+	if len(p.partial) > 0 {
+		_ = p.write(append(p.partial, '\n'))
+		p.partial = nil
+	}
+}
+
+func (p *prefixWriter) write(lines []byte) error {
+	buf := &bytes.Buffer{}
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		buf.WriteString(p.prefix)
+		buf.Write(lines[:i+1])
+		lines = lines[i+1:]
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,64 @@
+package wsexec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	targets := []Target{{Pod: "web-1"}, {Pod: "web-2"}, {Pod: "web-10"}}
+	var running, most int32
+	exec := func(ctx context.Context, target Target, stdout, stderr io.Writer) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		switch target.Pod {
+		case "web-1":
+			_, _ = io.WriteString(stdout, "up 3 days\nload")
+			_, _ = io.WriteString(stdout, " 0.1\n")
+		case "web-2":
+			_, _ = io.WriteString(stderr, "no such file")
+			return &ExitError{Code: 2}
+		case "web-10":
+			return errors.New("pod not found")
+		}
+		return nil
+	}
+
+	w := &bytes.Buffer{}
+	err := NewFanOut(WithFanOutParallelism(2)).Run(context.Background(), w, targets, exec)
+	var fanOutErr *FanOutError
+	if !errors.As(err, &fanOutErr) || fanOutErr.Failed != 2 || fanOutErr.Total != 3 {
+		t.Errorf("expected 2 of 3 failed, got %v", err)
+	}
+	if most > 2 {
+		t.Errorf("expected at most 2 running at once, got %d", most)
+	}
+
+	output := w.String()
+	for _, expected := range []string{
+		"web-1  | up 3 days\nweb-1  | load 0.1\n",
+		"web-2  | no such file\n",
+		"POD     EXIT CODE  ERROR\n" +
+			"web-1   0          \n" +
+			"web-2   2          command terminated with exit code 2\n" +
+			"web-10  -          pod not found\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected %q in %q", expected, output)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package wsexec
+
+import (
+	"context"
+	"sync"
+)
+
+// Flow control is credit based, the receiver of a direction grants the sender credit in bytes and
+// the sender never has more data in flight than it's been granted. A sender that has never been
+// granted credit isn't limited, so peers without flow control keep working. What it sends before
+// the first grant is still counted, as the receiver hands back credit for every byte it consumes.
+
+// sendWindow is the credit the peer granted us.
+type sendWindow struct {
+	mu      sync.Mutex
+	enabled bool
+	credit  int64
+	// granted wakes up a blocked acquire
+	granted chan struct{}
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{granted: make(chan struct{}, 1)}
+}
+
+// grant adds credit and enables flow control.
+func (w *sendWindow) grant(n int64) {
+	w.mu.Lock()
+	w.enabled = true
+	w.credit += n
+	w.mu.Unlock()
+
+	w.wake()
+}
+
+// wake wakes up a blocked acquire, if any.
+func (w *sendWindow) wake() {
+	select {
+	case w.granted <- struct{}{}:
+	default:
+	}
+}
+
+// acquire blocks until there's credit and takes up to n bytes of it, the caller sends that many.
+func (w *sendWindow) acquire(ctx context.Context, n int) (int, error) {
+	for {
+		w.mu.Lock()
+		if !w.enabled {
+			w.credit -= int64(n)
+			w.mu.Unlock()
+			return n, nil
+		}
+		if w.credit > 0 {
+			if int64(n) > w.credit {
+				n = int(w.credit)
+			}
+			w.credit -= int64(n)
+			left := w.credit > 0
+			w.mu.Unlock()
+			if left {
+				// another sender may be waiting for the same grant, e.g. the streams of a port forward
+				w.wake()
+			}
+			return n, nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.granted:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// recvWindow tracks what we received and hands back credit once half the window has been consumed,
+// so the sender never stalls on a round trip while the consumer keeps up.
+type recvWindow struct {
+	mu       sync.Mutex
+	size     int64
+	consumed int64
+}
+
+// consume records n consumed bytes and returns the credit to grant, or 0 when it's not worth it yet.
+func (w *recvWindow) consume(n int) int64 {
+	if w.size <= 0 {
+		return 0
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.consumed += int64(n)
+	if w.consumed < w.size/2 {
+		return 0
+	}
+	credit := w.consumed
+	w.consumed = 0
+	return credit
+}
@@ -0,0 +1,138 @@
+package wsexec
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lixianyang/wsexec/term"
+)
+
+func TestSendWindow(t *testing.T) {
+	w := newSendWindow()
+	// no limit until the peer grants credit
+	if n, err := w.acquire(context.Background(), 1<<20); n != 1<<20 || err != nil {
+		t.Errorf("expected %d without flow control, got %d %v", 1<<20, n, err)
+	}
+
+	w = newSendWindow()
+	w.grant(10)
+	if n, _ := w.acquire(context.Background(), 25); n != 10 {
+		t.Errorf("expected the 10 bytes of credit, got %d", n)
+	}
+
+	acquired := make(chan int)
+	go func() {
+		n, _ := w.acquire(context.Background(), 25)
+		acquired <- n
+	}()
+	select {
+	case n := <-acquired:
+		t.Fatalf("expected acquire to block without credit, got %d", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.grant(5)
+	if n := <-acquired; n != 5 {
+		t.Errorf("expected the 5 bytes granted, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if n, err := w.acquire(ctx, 25); n != 0 || err != context.Canceled {
+		t.Errorf("expected %v, got %d %v", context.Canceled, n, err)
+	}
+}
+
+func TestRecvWindow(t *testing.T) {
+	w := recvWindow{size: 100}
+	steps := []struct {
+		consumed int
+		credit   int64
+	}{
+		{consumed: 30},
+		// half the window has been consumed
+		{consumed: 20, credit: 50},
+		{consumed: 10},
+		{consumed: 70, credit: 80},
+	}
+	for i, step := range steps {
+		if credit := w.consume(step.consumed); credit != step.credit {
+			t.Errorf("step %d: expected credit %d, got %d", i, step.credit, credit)
+		}
+	}
+
+	if credit := (&recvWindow{}).consume(1 << 20); credit != 0 {
+		t.Errorf("expected no credit without flow control, got %d", credit)
+	}
+}
+
+// gatedWriter blocks writes until it's opened.
+type gatedWriter struct {
+	open chan struct{}
+	lockedBuffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.open
+	return w.lockedBuffer.Write(p)
+}
+
+func TestFlowControl(t *testing.T) {
+	const window = 1024
+	output := bytes.Repeat([]byte("0123456789abcdef"), 512)
+	var written int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s := NewServer(conn)
+		go s.Keepalive()
+		// what's sent before the first grant isn't limited
+		for enabled := false; !enabled; time.Sleep(time.Millisecond) {
+			s.outputWindow.mu.Lock()
+			enabled = s.outputWindow.enabled
+			s.outputWindow.mu.Unlock()
+		}
+		for p := output; len(p) > 0; p = p[256:] {
+			if _, err = s.Write(p[:256]); err != nil {
+				break
+			}
+			atomic.AddInt64(&written, 256)
+		}
+		s.Close(err)
+		<-s.Done()
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &gatedWriter{open: make(chan struct{})}
+	cli := NewClient(conn, WithClientTTY(term.TTY{Out: out}), WithClientFlowControl(window))
+	done := make(chan error, 1)
+	go func() {
+		done <- cli.Logs()
+	}()
+
+	// the terminal doesn't take the output, the server stops at the window
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&written); n > window {
+		t.Errorf("expected at most %d bytes written ahead of the terminal, got %d", window, n)
+	}
+
+	close(out.open)
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+	if out.String() != string(output) {
+		t.Errorf("expected %d bytes of output, got %d", len(output), len(out.String()))
+	}
+}
@@ -0,0 +1,402 @@
+package wsexec
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A port forward relays the TCP connections the client accepts to a port of the target. Each
+// connection is a stream of the session, every data message starts with a header of the operation
+// and the stream id. The streams share the credit, rate limits and keepalive of the session, so a
+// connection that doesn't read its data stalls the others.
+
+// Operations of the forward header.
+const (
+	forwardData byte = iota
+	// forwardOpen is sent by the client for an accepted connection, the server dials the port
+	forwardOpen
+	// forwardEOF tells the sender won't send anymore, the receiver closes the write side of its connection
+	forwardEOF
+	// forwardReset ends the stream on both sides, the payload is the reason
+	forwardReset
+)
+
+const (
+	forwardHeaderSize = 5
+	// forwardChunkSize is the most data a message carries
+	forwardChunkSize = 32 * 1024
+)
+
+func forwardHeader(op byte, id uint32) []byte {
+	header := make([]byte, forwardHeaderSize)
+	header[0] = op
+	binary.BigEndian.PutUint32(header[1:], id)
+	return header
+}
+
+func decodeForward(data []byte) (op byte, id uint32, payload []byte, err error) {
+	if len(data) < forwardHeaderSize || data[0] > forwardReset {
+		return 0, 0, nil, fmt.Errorf("%w: forward header %q", ErrMalformedMessage, data)
+	}
+	return data[0], binary.BigEndian.Uint32(data[1:]), data[forwardHeaderSize:], nil
+}
+
+// ForwardDialer dials the forwarded port for every connection the client accepts.
+type ForwardDialer interface {
+	Dial(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// ForwardDialerFunc is an adapter to allow the use of ordinary functions as ForwardDialer.
+type ForwardDialerFunc func(ctx context.Context) (io.ReadWriteCloser, error)
+
+func (f ForwardDialerFunc) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	return f(ctx)
+}
+
+// NewNetForwardDialer dials address on network, e.g. a port of the gateway host or of a pod IP.
+func NewNetForwardDialer(network, address string) ForwardDialer {
+	return ForwardDialerFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	})
+}
+
+// forwardStream is a connection relayed over the session.
+type forwardStream struct {
+	id   uint32
+	conn io.ReadWriteCloser
+	// sent and received are set once the direction is over, the stream is closed once both are
+	sent, received bool
+}
+
+// forwardMux relays the streams of either side, send writes a message to the peer.
+type forwardMux struct {
+	send   func(op byte, id uint32, p []byte) error
+	logger Logger
+
+	mu      sync.Mutex
+	streams map[uint32]*forwardStream
+}
+
+func newForwardMux(logger Logger, send func(op byte, id uint32, p []byte) error) *forwardMux {
+	return &forwardMux{send: send, logger: logger, streams: make(map[uint32]*forwardStream)}
+}
+
+// add registers conn as stream id, the caller starts relaying it with pump.
+func (m *forwardMux) add(id uint32, conn io.ReadWriteCloser) *forwardStream {
+	st := &forwardStream{id: id, conn: conn}
+	m.mu.Lock()
+	m.streams[id] = st
+	m.mu.Unlock()
+
+	return st
+}
+
+func (m *forwardMux) get(id uint32) *forwardStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.streams[id]
+}
+
+// pump sends what the connection of st reads until it's over.
+func (m *forwardMux) pump(st *forwardStream) {
+	buf := make([]byte, forwardChunkSize)
+	for {
+		n, err := st.conn.Read(buf)
+		if n > 0 {
+			if e := m.send(forwardData, st.id, buf[:n]); e != nil {
+				m.remove(st.id)
+				return
+			}
+		}
+		if err == io.EOF {
+			if e := m.send(forwardEOF, st.id, nil); e != nil {
+				m.remove(st.id)
+				return
+			}
+			m.finish(st.id, true)
+			return
+		}
+		if err != nil {
+			m.reset(st.id, err)
+			return
+		}
+	}
+}
+
+// dispatch handles a message of the peer for stream id, streams it doesn't know have just been reset.
+func (m *forwardMux) dispatch(op byte, id uint32, payload []byte) {
+	st := m.get(id)
+	if st == nil {
+		return
+	}
+
+	switch op {
+	case forwardData:
+		if _, err := st.conn.Write(payload); err != nil {
+			m.reset(id, err)
+		}
+	case forwardEOF:
+		if cw, ok := st.conn.(interface{ CloseWrite() error }); ok {
+			if err := cw.CloseWrite(); err != nil {
+				m.logger.Println("close write of stream ", id, " err ", err)
+			}
+		}
+		m.finish(id, false)
+	case forwardReset:
+		m.logger.Println("stream ", id, " reset by peer ", string(payload))
+		m.remove(id)
+	}
+}
+
+// finish records that a direction of stream id is over, sent tells which one.
+func (m *forwardMux) finish(id uint32, sent bool) {
+	m.mu.Lock()
+	st := m.streams[id]
+	if st == nil {
+		m.mu.Unlock()
+		return
+	}
+	if sent {
+		st.sent = true
+	} else {
+		st.received = true
+	}
+	done := st.sent && st.received
+	if done {
+		delete(m.streams, id)
+	}
+	m.mu.Unlock()
+
+	if done {
+		_ = st.conn.Close()
+	}
+}
+
+// reset ends stream id because of err and tells the peer.
+func (m *forwardMux) reset(id uint32, err error) {
+	if m.remove(id) {
+		m.logger.Println("reset stream ", id, " with err ", err)
+		if e := m.send(forwardReset, id, []byte(err.Error())); e != nil {
+			m.logger.Println("send reset of stream ", id, " err ", e)
+		}
+	}
+}
+
+// remove closes stream id and reports whether it was still there.
+func (m *forwardMux) remove(id uint32) bool {
+	m.mu.Lock()
+	st := m.streams[id]
+	delete(m.streams, id)
+	m.mu.Unlock()
+
+	if st == nil {
+		return false
+	}
+	_ = st.conn.Close()
+	return true
+}
+
+// closeAll closes the streams once the session is over.
+func (m *forwardMux) closeAll() {
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = make(map[uint32]*forwardStream)
+	m.mu.Unlock()
+
+	for _, st := range streams {
+		_ = st.conn.Close()
+	}
+}
+
+// ServeForward relays the connections the client accepts, see Client.Forward, to connections of
+// dialer until the session ends. The client must speak the wsexec protocol. Connections are dialed
+// one at a time, in the order the client accepted them.
+func ServeForward(s *Server, dialer ForwardDialer) error {
+	if _, ok := s.codec.(wsexecCodec); !ok {
+		return fmt.Errorf("%w: port forwarding needs the wsexec protocol", ErrUnexpectedMessageType)
+	}
+
+	m := newForwardMux(s.logger, func(op byte, id uint32, p []byte) error {
+		if op == forwardData {
+			_, err := s.writeOutput(forwardHeader(op, id), p)
+			return err
+		}
+		// the stream operations take no credit
+		return s.writeData(forwardHeader(op, id), p)
+	})
+	defer m.closeAll()
+
+	for {
+		data, err := s.readMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 || string(data) == EndOfTransmission {
+			// the end of the remote process input, which is meaningless here
+			continue
+		}
+
+		op, id, payload, err := decodeForward(data)
+		if err != nil {
+			return err
+		}
+		if op == forwardData {
+			s.consumeInput(len(payload))
+		}
+		if op != forwardOpen {
+			m.dispatch(op, id, payload)
+			continue
+		}
+
+		if m.get(id) != nil {
+			return fmt.Errorf("%w: stream %d is open already", ErrMalformedMessage, id)
+		}
+		conn, err := dialer.Dial(s.Context())
+		if err != nil {
+			s.logger.Println("dial stream ", id, " err ", err)
+			if err = s.writeData(forwardHeader(forwardReset, id), []byte(err.Error())); err != nil {
+				return err
+			}
+			continue
+		}
+		s.logger.Println("stream ", id, " opened")
+		go m.pump(m.add(id, conn))
+	}
+}
+
+// Forward relays the connections l accepts to the port of a session the server runs with ServeForward.
+// It returns once the session ended, or nil once l has been closed which ends the session.
+func (cli *Client) Forward(l net.Listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := newForwardMux(cli.logger, func(op byte, id uint32, p []byte) error {
+		return cli.sendForward(ctx, op, id, p)
+	})
+	defer m.closeAll()
+	defer cancel()
+
+	go cli.send()
+	if cli.outputWindow.size > 0 {
+		if err := cli.grantCredit(cli.outputWindow.size); err != nil {
+			return err
+		}
+	}
+	go cli.forwardOut(ctx, m)
+	go cli.accept(ctx, l, m)
+
+	err := <-cli.errChan
+	_ = l.Close()
+	if errors.Is(err, net.ErrClosed) {
+		cli.logger.Println("listener closed, end the session")
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		return cli.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	}
+
+	var closeError *websocket.CloseError
+	if errors.As(err, &closeError) {
+		if code, ok := cli.exitCode.Load().(int); ok && code == 0 {
+			return nil
+		}
+		return fmt.Errorf("port forward failed: %w", closeError)
+	}
+	return err
+}
+
+// accept opens a stream for every connection l accepts.
+func (cli *Client) accept(ctx context.Context, l net.Listener, m *forwardMux) {
+	for id := uint32(1); ; id++ {
+		conn, err := l.Accept()
+		if err != nil {
+			cli.logger.Println("accept goroutine returned with err ", err)
+			cli.fail(ctx, fmt.Errorf("accept connection %w", err))
+			return
+		}
+		// the stream is known before the server can reset it
+		st := m.add(id, conn)
+		if err = cli.sendForward(ctx, forwardOpen, id, nil); err != nil {
+			m.remove(id)
+			return
+		}
+		go m.pump(st)
+	}
+}
+
+// forwardOut relays the messages of the server to the streams.
+func (cli *Client) forwardOut(ctx context.Context, m *forwardMux) {
+	cli.logger.Println("forward goroutine start")
+
+	for {
+		t, data, err := cli.conn.ReadMessage()
+		if err != nil {
+			cli.logger.Println("forward goroutine returned with read message err ", err)
+			cli.fail(ctx, fmt.Errorf("read data from connection %w", err))
+			return
+		}
+		if isControlType(t) {
+			if err = cli.handleControl(bytes.NewReader(data)); err != nil {
+				cli.fail(ctx, fmt.Errorf("handle control message %w", err))
+				return
+			}
+			continue
+		}
+
+		op, id, payload, err := decodeForward(data)
+		if err != nil {
+			cli.fail(ctx, err)
+			return
+		}
+		m.dispatch(op, id, payload)
+		if op != forwardData {
+			continue
+		}
+		if credit := cli.outputWindow.consume(len(payload)); credit > 0 {
+			if err = cli.grantCredit(credit); err != nil {
+				cli.fail(ctx, fmt.Errorf("grant output credit %w", err))
+				return
+			}
+		}
+	}
+}
+
+// sendForward queues a message of stream id, data within the input credit granted by the server.
+func (cli *Client) sendForward(ctx context.Context, op byte, id uint32, p []byte) error {
+	for {
+		n := len(p)
+		if op == forwardData {
+			var err error
+			if n, err = cli.inputWindow.acquire(ctx, len(p)); err != nil {
+				return err
+			}
+		}
+		data := append(forwardHeader(op, id), p[:n]...)
+		select {
+		case cli.writeChan <- newDataMessage(data):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if p = p[n:]; len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// fail ends Forward with err unless it has ended already.
+func (cli *Client) fail(ctx context.Context, err error) {
+	select {
+	case cli.errChan <- err:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,122 @@
+package wsexec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// echo answers what each connection sent once it closed its write side.
+func echo(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				_, _ = conn.Write(data)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestForward(t *testing.T) {
+	target := echo(t)
+	defer target.Close()
+
+	testcases := map[string]struct {
+		dialer   ForwardDialer
+		payloads []string
+		expected []string
+	}{
+		"echo": {
+			dialer:   NewNetForwardDialer("tcp", target.Addr().String()),
+			payloads: []string{"hello", strings.Repeat("0123456789", 10000), ""},
+			expected: []string{"hello", strings.Repeat("0123456789", 10000), ""},
+		},
+		"dial error": {
+			dialer: ForwardDialerFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+				return nil, errors.New("connection refused")
+			}),
+			payloads: []string{"hello"},
+			expected: []string{""},
+		},
+	}
+	for k, tc := range testcases {
+		served := make(chan error, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			s := NewServer(conn, WithServerFlowControl(16*1024))
+			go s.Keepalive()
+			err = ServeForward(s, tc.dialer)
+			s.Close(err)
+			served <- err
+		}))
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		forwarded := make(chan error, 1)
+		go func() {
+			forwarded <- NewClient(conn, WithClientFlowControl(16*1024)).Forward(l)
+		}()
+
+		var wg sync.WaitGroup
+		for i, payload := range tc.payloads {
+			wg.Add(1)
+			go func(payload, expected string) {
+				defer wg.Done()
+				c, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Errorf("%s: %s", k, err)
+					return
+				}
+				defer c.Close()
+				if _, err = c.Write([]byte(payload)); err != nil {
+					t.Errorf("%s: %s", k, err)
+				}
+				_ = c.(*net.TCPConn).CloseWrite()
+				got, _ := io.ReadAll(c)
+				if !bytes.Equal(got, []byte(expected)) {
+					t.Errorf("%s: expected %d bytes, got %d %.32q", k, len(expected), len(got), got)
+				}
+			}(payload, tc.expected[i])
+		}
+		wg.Wait()
+
+		// closing the listener ends the session
+		_ = l.Close()
+		if err = <-forwarded; err != nil {
+			t.Errorf("%s: forward returned %s", k, err)
+		}
+		if err = <-served; err != nil {
+			t.Errorf("%s: serve forward returned %s", k, err)
+		}
+		ts.Close()
+	}
+}
@@ -7,6 +7,8 @@ require (
 	github.com/mitchellh/go-wordwrap v1.0.0
 	github.com/moby/term v0.0.0-20201216013528-df9cb8a40635
 	golang.org/x/sys v0.0.0-20201112073958-5cba982894dd
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	k8s.io/api v0.18.16
 	k8s.io/apimachinery v0.18.16
 	k8s.io/client-go v0.18.16
 )
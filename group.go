@@ -0,0 +1,355 @@
+package wsexec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// GroupToggleKey starts a key sequence of a session group: followed by the number of a target it
+// toggles whether the input goes to the target, followed by 0 it sends the input to every target
+// again, and typed twice it sends itself. It's ctrl-]. A number that's the beginning of the numbers
+// of other targets, such as 1 of 12 targets, is toggled by the next key that isn't a digit.
+const GroupToggleKey = '\x1d'
+
+// SessionGroup drives the shells of several targets from a single session, cluster ssh style. The
+// input of the client goes to every target, unless the user toggled it off with GroupToggleKey, and
+// the output of every target is tagged with its pod name. Tagging suits line oriented programs,
+// full screen programs such as editors mix up the output of the targets.
+type SessionGroup struct {
+	s       *Server
+	members []*GroupMember
+	// tagWidth is how many columns the tags take
+	tagWidth int
+
+	// mu guards enabled of the members
+	mu sync.Mutex
+
+	// outMu serializes the output of the members, it's held while writing to the session so that
+	// the tags follow the order of the output, but never by the input
+	outMu sync.Mutex
+	// last is the member that wrote last, lineStart tells whether its output ended a line
+	last      *GroupMember
+	lineStart bool
+}
+
+// GroupMember is the terminal of a target of a session group, it's the stdin, stdout and terminal
+// size queue of the shell of the target.
+type GroupMember struct {
+	group   *SessionGroup
+	target  Target
+	tag     string
+	enabled bool
+	input   chan []byte
+	// pending is the part of the last input not returned by Read yet, only accessed by Read
+	pending []byte
+	sizes   chan remotecommand.TerminalSize
+	done    chan struct{}
+}
+
+func NewSessionGroup(s *Server, targets []Target) *SessionGroup {
+	g := &SessionGroup{s: s, lineStart: true}
+
+	width := 0
+	for _, target := range targets {
+		if len(target.Pod) > width {
+			width = len(target.Pod)
+		}
+	}
+	g.tagWidth = width + len(" | ")
+	for i, target := range targets {
+		g.members = append(g.members, &GroupMember{
+			group:   g,
+			target:  target,
+			tag:     fmt.Sprintf("%s%-*s |\x1b[0m ", fanOutColors[i%len(fanOutColors)], width, target.Pod),
+			enabled: true,
+			input:   make(chan []byte, 16),
+			sizes:   make(chan remotecommand.TerminalSize, 1),
+			done:    make(chan struct{}),
+		})
+	}
+	return g
+}
+
+// Run runs the shell of every member with exec, until all of them exited. It returns a *FanOutError
+// when some of them failed.
+func (g *SessionGroup) Run(exec func(m *GroupMember) error) error {
+	names := make([]string, len(g.members))
+	for i, m := range g.members {
+		names[i] = fmt.Sprintf("%d %s", i+1, m.target.Pod)
+	}
+	if err := g.s.Notify("input goes to " + strings.Join(names, ", ") + ", ctrl-] and a number toggles a pod"); err != nil {
+		g.s.logger.Println("send session group notice err ", err)
+	}
+
+	go g.broadcastInput()
+	go g.broadcastSizes()
+
+	results := make([]FanOutResult, len(g.members))
+	var wg sync.WaitGroup
+	for i, m := range g.members {
+		wg.Add(1)
+		go func(i int, m *GroupMember) {
+			defer wg.Done()
+
+			err := exec(m)
+			close(m.done)
+			code, ok := exitStatus(err)
+			if !ok {
+				code = -1
+			}
+			results[i] = FanOutResult{Target: m.target, ExitCode: code, Err: err}
+			if e := g.s.Notify(fmt.Sprintf("%s exited with %s", m.target.Pod, exitDescription(code, err))); e != nil {
+				g.s.logger.Println("send member exit notice err ", e)
+			}
+		}(i, m)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r.ExitCode != 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return &FanOutError{Failed: failed, Total: len(results)}
+	}
+	return nil
+}
+
+func exitDescription(code int, err error) string {
+	if code < 0 {
+		return err.Error()
+	}
+	return fmt.Sprintf("status %d", code)
+}
+
+// broadcastInput sends the input of the client to the enabled members, until the session ends.
+func (g *SessionGroup) broadcastInput() {
+	defer func() {
+		for _, m := range g.members {
+			close(m.input)
+		}
+	}()
+
+	in := newGroupInput(len(g.members))
+	buf := make([]byte, 1024)
+	for {
+		n, err := g.s.Read(buf)
+		if err != nil {
+			g.s.logger.Println("session group input returned with err ", err)
+			return
+		}
+		in.parse(buf[:n], g.send, g.toggle)
+	}
+}
+
+// groupInput splits the input of the client into the input of the members and the numbers typed
+// after GroupToggleKey.
+type groupInput struct {
+	members int
+	escaped bool
+	// number is the number typed after GroupToggleKey so far, -1 when none is
+	number int
+}
+
+func newGroupInput(members int) *groupInput {
+	return &groupInput{members: members, number: -1}
+}
+
+// parse calls send with the input and toggle with the numbers in the order they were typed, a
+// number that may go on is kept until the next input.
+func (in *groupInput) parse(p []byte, send func(data []byte), toggle func(number int)) {
+	data := make([]byte, 0, len(p))
+	flush := func() {
+		if len(data) > 0 {
+			send(data)
+			data = data[len(data):]
+		}
+	}
+	for _, b := range p {
+		if in.number >= 0 {
+			if b >= '0' && b <= '9' && in.number*10+int(b-'0') <= in.members {
+				in.number = in.number*10 + int(b-'0')
+				in.toggleIfComplete(toggle)
+				continue
+			}
+			toggle(in.number)
+			in.number = -1
+		}
+
+		switch {
+		case in.escaped:
+			in.escaped = false
+			switch {
+			case b == GroupToggleKey:
+				data = append(data, b)
+			case b >= '0' && b <= '9':
+				flush()
+				in.number = int(b - '0')
+				in.toggleIfComplete(toggle)
+			}
+		case b == GroupToggleKey:
+			in.escaped = true
+		default:
+			data = append(data, b)
+		}
+	}
+	flush()
+}
+
+// toggleIfComplete toggles the number unless it's the beginning of the number of another member.
+func (in *groupInput) toggleIfComplete(toggle func(number int)) {
+	if in.number == 0 || in.number*10 > in.members {
+		toggle(in.number)
+		in.number = -1
+	}
+}
+
+// send sends data to the enabled members.
+func (g *SessionGroup) send(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	for _, m := range g.members {
+		g.mu.Lock()
+		enabled := m.enabled
+		g.mu.Unlock()
+		if !enabled {
+			continue
+		}
+
+		select {
+		case m.input <- data:
+		case <-m.done:
+		}
+	}
+}
+
+// toggle handles the number typed after GroupToggleKey and tells the user which members get the input.
+func (g *SessionGroup) toggle(number int) {
+	g.mu.Lock()
+	switch {
+	case number == 0:
+		for _, m := range g.members {
+			m.enabled = true
+		}
+	case number >= 1 && number <= len(g.members):
+		m := g.members[number-1]
+		m.enabled = !m.enabled
+	default:
+		g.mu.Unlock()
+		return
+	}
+	var on, off []string
+	for _, m := range g.members {
+		if m.enabled {
+			on = append(on, m.target.Pod)
+		} else {
+			off = append(off, m.target.Pod)
+		}
+	}
+	g.mu.Unlock()
+
+	message := "input goes to " + strings.Join(on, ", ")
+	if len(on) == 0 {
+		message = "input goes nowhere"
+	}
+	if len(off) > 0 {
+		message += ", not to " + strings.Join(off, ", ")
+	}
+	if err := g.s.Notify(message); err != nil {
+		g.s.logger.Println("send toggle notice err ", err)
+	}
+}
+
+// broadcastSizes resizes the terminals of the members with the client terminal, less the width of the tags.
+func (g *SessionGroup) broadcastSizes() {
+	for {
+		size := g.s.Next()
+		if size == nil {
+			return
+		}
+		for _, m := range g.members {
+			resized := *size
+			if tagWidth := uint16(g.tagWidth); resized.Width > tagWidth {
+				resized.Width -= tagWidth
+			}
+			// only the latest size matters
+			select {
+			case <-m.sizes:
+			default:
+			}
+			m.sizes <- resized
+		}
+	}
+}
+
+// Target returns the target of the member.
+func (m *GroupMember) Target() Target {
+	return m.target
+}
+
+// Read returns the input broadcast to the member.
+func (m *GroupMember) Read(p []byte) (int, error) {
+	if len(m.pending) == 0 {
+		data, ok := <-m.input
+		if !ok {
+			return 0, io.EOF
+		}
+		m.pending = data
+	}
+
+	n := copy(p, m.pending)
+	m.pending = m.pending[n:]
+	return n, nil
+}
+
+// Write sends the output of the member tagged with its pod name at the start of every line.
+func (m *GroupMember) Write(p []byte) (int, error) {
+	g := m.group
+	g.outMu.Lock()
+	defer g.outMu.Unlock()
+
+	buf := &bytes.Buffer{}
+	if g.last != m && !g.lineStart {
+		// the line of another member isn't over, e.g. a prompt
+		buf.WriteString("\r\n")
+		g.lineStart = true
+	}
+	g.last = m
+	for rest := p; len(rest) > 0; {
+		if g.lineStart {
+			buf.WriteString(m.tag)
+			g.lineStart = false
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			buf.Write(rest)
+			break
+		}
+		buf.Write(rest[:i+1])
+		rest = rest[i+1:]
+		g.lineStart = true
+	}
+
+	if _, err := g.s.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Next returns the terminal size of the member, nil once its shell exited.
+func (m *GroupMember) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-m.sizes:
+		return &size
+	case <-m.done:
+		return nil
+	}
+}
@@ -0,0 +1,115 @@
+package wsexec
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionGroup(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s := NewServer(conn)
+		go s.Keepalive()
+		g := NewSessionGroup(s, []Target{{Pod: "web-1"}, {Pod: "web-2"}})
+		err = g.Run(func(m *GroupMember) error {
+			// a shell echoing its input
+			scanner := bufio.NewScanner(m)
+			for scanner.Scan() {
+				fmt.Fprintf(m, "got %s\n", scanner.Text())
+				if scanner.Text() == "exit" && m.Target().Pod == "web-2" {
+					return &ExitError{Code: 3}
+				}
+				if scanner.Text() == "exit" {
+					return nil
+				}
+			}
+			return scanner.Err()
+		})
+		s.Close(err)
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// web-2 doesn't get pwd
+	input := "ls\n" + string(GroupToggleKey) + "2pwd\n" + string(GroupToggleKey) + "0exit\n"
+	if err = conn.WriteMessage(websocket.BinaryMessage, []byte(input)); err != nil {
+		t.Fatal(err)
+	}
+
+	output := &strings.Builder{}
+	var exit string
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if typ == websocket.BinaryMessage {
+			output.Write(data)
+		} else if strings.Contains(string(data), `"exit"`) {
+			exit = string(data)
+		}
+	}
+
+	for _, line := range []string{"web-1 |\x1b[0m got ls\n", "web-2 |\x1b[0m got ls\n", "web-1 |\x1b[0m got pwd\n", "web-1 |\x1b[0m got exit\n", "web-2 |\x1b[0m got exit\n"} {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("expected %q in %q", line, output.String())
+		}
+	}
+	if strings.Contains(output.String(), "web-2 |\x1b[0m got pwd") {
+		t.Errorf("expected web-2 to be toggled off in %q", output.String())
+	}
+	if !strings.Contains(exit, `"exitCode":1`) {
+		t.Errorf("expected exit code 1, got %s", exit)
+	}
+}
+
+func TestGroupInput(t *testing.T) {
+	key := string(GroupToggleKey)
+	testcases := map[string]struct {
+		members  int
+		input    []string
+		expected string
+	}{
+		"plain":          {members: 3, input: []string{"ls\n"}, expected: "ls\n"},
+		"toggle":         {members: 3, input: []string{"ls" + key + "2pwd"}, expected: "ls[2]pwd"},
+		"all":            {members: 3, input: []string{key + "0ls"}, expected: "[0]ls"},
+		"escaped key":    {members: 3, input: []string{key + key + "ls"}, expected: key + "ls"},
+		"unknown key":    {members: 3, input: []string{key + "als"}, expected: "ls"},
+		"no such member": {members: 3, input: []string{key + "4ls"}, expected: "[4]ls"},
+		"split":          {members: 3, input: []string{"ls" + key, "2pwd"}, expected: "ls[2]pwd"},
+		// 1 may be the beginning of 10 to 12
+		"two digits":       {members: 12, input: []string{key + "12ls"}, expected: "[12]ls"},
+		"ended by a key":   {members: 12, input: []string{key + "1ls"}, expected: "[1]ls"},
+		"ended by a digit": {members: 12, input: []string{key + "134"}, expected: "[1]34"},
+		"single digit":     {members: 12, input: []string{key + "2ls"}, expected: "[2]ls"},
+		"two digits split": {members: 12, input: []string{key + "1", "1ls"}, expected: "[11]ls"},
+		"pending":          {members: 12, input: []string{key + "1"}, expected: ""},
+	}
+	for k, tc := range testcases {
+		got := &strings.Builder{}
+		in := newGroupInput(tc.members)
+		for _, input := range tc.input {
+			in.parse([]byte(input), func(data []byte) {
+				got.Write(data)
+			}, func(number int) {
+				fmt.Fprintf(got, "[%d]", number)
+			})
+		}
+		if got.String() != tc.expected {
+			t.Errorf("%s: expected %q, got %q", k, tc.expected, got.String())
+		}
+	}
+}
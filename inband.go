@@ -0,0 +1,428 @@
+package wsexec
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// InBandProtocol is a file transfer protocol started by a remote process in the terminal stream,
+// such as sz or trz run in a shell.
+type InBandProtocol string
+
+const (
+	// ZmodemReceive is started by sz, the client receives files.
+	ZmodemReceive InBandProtocol = "zmodem-receive"
+	// ZmodemSend is started by rz, the client sends files.
+	ZmodemSend InBandProtocol = "zmodem-send"
+	// TrzszReceive is started by tsz, the client receives files.
+	TrzszReceive InBandProtocol = "trzsz-receive"
+	// TrzszSend is started by trz, the client sends files.
+	TrzszSend InBandProtocol = "trzsz-send"
+)
+
+// inBandSequences start the transfers in the output, the ZMODEM ones are the hex headers of ZRQINIT
+// and ZRINIT.
+var inBandSequences = []struct {
+	start    []byte
+	protocol InBandProtocol
+}{
+	{start: []byte("**\x18B00"), protocol: ZmodemReceive},
+	{start: []byte("**\x18B01"), protocol: ZmodemSend},
+	{start: []byte("::TRZSZ:TRANSFER:S:"), protocol: TrzszReceive},
+	{start: []byte("::TRZSZ:TRANSFER:R:"), protocol: TrzszSend},
+	{start: []byte("::TRZSZ:TRANSFER:D:"), protocol: TrzszSend},
+}
+
+// inBandAborts cancel a transfer the client can't run, ZMODEM is canceled by a row of CAN and trzsz
+// by declining the transfer.
+var inBandAborts = map[InBandProtocol][]byte{
+	ZmodemReceive: []byte("\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08"),
+	ZmodemSend:    []byte("\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08"),
+	TrzszReceive:  trzszAction(false),
+	TrzszSend:     trzszAction(false),
+}
+
+// trzszAction returns the action line a trzsz client answers the start sequence with, a zlib
+// compressed json in base64, confirm false makes trz and tsz cancel the transfer.
+func trzszAction(confirm bool) []byte {
+	action, _ := json.Marshal(map[string]interface{}{"lang": "go", "confirm": confirm, "version": "1.1.5"})
+	buf := &bytes.Buffer{}
+	z := zlib.NewWriter(buf)
+	_, _ = z.Write(action)
+	_ = z.Close()
+	return []byte("#ACT:" + base64.StdEncoding.EncodeToString(buf.Bytes()) + "\n")
+}
+
+// inBandHoldTimeout is how long the end of the output that may be the beginning of a start sequence
+// is held back, e.g. a prompt ending in ** is shown once no more output follows.
+const inBandHoldTimeout = 50 * time.Millisecond
+
+// detectInBand returns where a transfer starts in p, or -1.
+func detectInBand(p []byte) (int, InBandProtocol) {
+	index, protocol := -1, InBandProtocol("")
+	for _, seq := range inBandSequences {
+		if i := bytes.Index(p, seq.start); i >= 0 && (index < 0 || i < index) {
+			index, protocol = i, seq.protocol
+		}
+	}
+	return index, protocol
+}
+
+// partialInBand returns the length of the end of p that may be the beginning of a start sequence,
+// a single byte isn't worth holding back output for.
+func partialInBand(p []byte) int {
+	for n := len(p); n >= 2; n-- {
+		for _, seq := range inBandSequences {
+			if n < len(seq.start) && bytes.HasPrefix(seq.start, p[len(p)-n:]) {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// InBandTransferHandler runs a file transfer a remote process started in the terminal stream.
+// remote is the output of the remote process from the start sequence on and what's written to input
+// is sent to the remote process. The terminal resumes once Transfer returns, ctx is canceled by ctrl-c.
+type InBandTransferHandler interface {
+	Transfer(ctx context.Context, protocol InBandProtocol, remote io.Reader, input io.Writer) error
+}
+
+// InBandTransferHandlerFunc is an adapter to allow the use of ordinary functions as InBandTransferHandler.
+type InBandTransferHandlerFunc func(ctx context.Context, protocol InBandProtocol, remote io.Reader, input io.Writer) error
+
+func (f InBandTransferHandlerFunc) Transfer(ctx context.Context, protocol InBandProtocol, remote io.Reader, input io.Writer) error {
+	return f(ctx, protocol, remote, input)
+}
+
+type lrzszHandler struct {
+	dir   string
+	files func() ([]string, error)
+}
+
+// NewLrzszTransferHandler runs the ZMODEM transfers with rz and sz of lrzsz, which must be installed
+// locally. Files are received into dir, files returns the files to send, e.g. by asking the user.
+func NewLrzszTransferHandler(dir string, files func() ([]string, error)) InBandTransferHandler {
+	return &lrzszHandler{dir: dir, files: files}
+}
+
+func (h *lrzszHandler) Transfer(ctx context.Context, protocol InBandProtocol, remote io.Reader, input io.Writer) error {
+	var cmd *exec.Cmd
+	switch protocol {
+	case ZmodemReceive:
+		// -E renames files that already exist
+		cmd = exec.CommandContext(ctx, "rz", "-E", "-b")
+	case ZmodemSend:
+		files, err := h.files()
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return ErrTransferCanceled
+		}
+		cmd = exec.CommandContext(ctx, "sz", append([]string{"-b"}, files...)...)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedTransfer, protocol)
+	}
+
+	cmd.Dir = h.dir
+	cmd.Stdout = input
+	// the progress goes to the terminal
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	copyCtx, stop := context.WithCancel(ctx)
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		copyRemote(copyCtx, stdin, remote)
+	}()
+	err = cmd.Wait()
+	// the output following the transfer, such as the prompt, is left to the terminal
+	stop()
+	<-copied
+	return err
+}
+
+// copyRemote copies the remote output to the stdin of a command until ctx is done, the output the
+// command didn't take since it exited goes to the terminal after the transfer.
+func copyRemote(ctx context.Context, stdin io.Writer, remote io.Reader) {
+	r, ok := remote.(*inBandRemote)
+	if !ok {
+		_, _ = io.Copy(stdin, remote)
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.read(ctx, buf)
+		if n > 0 {
+			if written, e := stdin.Write(buf[:n]); e != nil {
+				r.unread(buf[written:n])
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// inBandRemote is the output of the remote process a transfer handler reads, handed over a chunk at
+// a time by the output flush goroutine.
+type inBandRemote struct {
+	chunks chan []byte
+	// done is closed once the transfer is over
+	done chan struct{}
+
+	mu sync.Mutex
+	// pending is the output taken from chunks the handler hasn't read yet, or gave back with unread
+	pending []byte
+}
+
+func newInBandRemote() *inBandRemote {
+	return &inBandRemote{chunks: make(chan []byte), done: make(chan struct{})}
+}
+
+func (r *inBandRemote) Read(p []byte) (int, error) {
+	return r.read(context.Background(), p)
+}
+
+// read is Read returning ctx.Err() once ctx is done, so a handler can stop reading without taking
+// output from the terminal.
+func (r *inBandRemote) read(ctx context.Context, p []byte) (int, error) {
+	r.mu.Lock()
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		r.mu.Unlock()
+		return n, nil
+	}
+	r.mu.Unlock()
+
+	select {
+	case chunk := <-r.chunks:
+		n := copy(p, chunk)
+		r.mu.Lock()
+		r.pending = chunk[n:]
+		r.mu.Unlock()
+		return n, nil
+	case <-r.done:
+		return 0, io.EOF
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// unread gives back output read but not used, it's written to the terminal after the transfer.
+func (r *inBandRemote) unread(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending = append(append([]byte(nil), p...), r.pending...)
+}
+
+// leftover returns the output the handler didn't use.
+func (r *inBandRemote) leftover() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.pending
+	r.pending = nil
+	return p
+}
+
+// inBandWriter writes the output to the terminal until a transfer starts, then to the transfer
+// handler until it returns. Write is only called by the output flush goroutine.
+type inBandWriter struct {
+	cli *Client
+
+	// outMu guards out, held and the hold timer, which writes held to out when it expires
+	outMu sync.Mutex
+	out   io.Writer
+	// held is the end of the last output, it may be the beginning of a start sequence
+	held []byte
+	// holds counts the output held back, so that an expired timer doesn't flush later output
+	holds int
+	timer *time.Timer
+
+	mu     sync.Mutex
+	active *inBandTransfer
+}
+
+type inBandTransfer struct {
+	remote *inBandRemote
+	cancel context.CancelFunc
+}
+
+func newInBandWriter(cli *Client, out io.Writer) *inBandWriter {
+	return &inBandWriter{cli: cli, out: out}
+}
+
+func (w *inBandWriter) current() *inBandTransfer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.active
+}
+
+func (w *inBandWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if t := w.current(); t != nil {
+			select {
+			case t.remote.chunks <- append([]byte(nil), p...):
+				return n, nil
+			case <-t.remote.done:
+			}
+			// the transfer is over, output the handler didn't take goes to the terminal as is, after
+			// the output it didn't use, it may start with the sequence of the transfer
+			if _, err := w.writeOut(p); err != nil {
+				return 0, err
+			}
+			return n, nil
+		}
+
+		rest, protocol, err := w.detect(p)
+		if err != nil {
+			return 0, err
+		}
+		if rest == nil {
+			return n, nil
+		}
+		w.start(protocol)
+		p = rest
+	}
+	return n, nil
+}
+
+func (w *inBandWriter) writeOut(p []byte) (int, error) {
+	w.outMu.Lock()
+	defer w.outMu.Unlock()
+
+	return w.out.Write(p)
+}
+
+// detect writes the output before a start sequence in the held output followed by p to the
+// terminal, and returns the output from the sequence on. Without one it returns nil and holds back
+// the end of the output that may begin a sequence until more output follows or the timeout expires.
+func (w *inBandWriter) detect(p []byte) ([]byte, InBandProtocol, error) {
+	w.outMu.Lock()
+	defer w.outMu.Unlock()
+
+	data := append(w.held, p...)
+	w.held = nil
+	w.holds++
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+
+	i, protocol := detectInBand(data)
+	if i >= 0 {
+		_, err := w.out.Write(data[:i])
+		return data[i:], protocol, err
+	}
+
+	keep := partialInBand(data)
+	if _, err := w.out.Write(data[:len(data)-keep]); err != nil {
+		return nil, "", err
+	}
+	if keep > 0 {
+		w.held = append([]byte(nil), data[len(data)-keep:]...)
+		holds := w.holds
+		w.timer = time.AfterFunc(inBandHoldTimeout, func() {
+			w.flushHeld(holds)
+		})
+	}
+	return nil, "", nil
+}
+
+// flushHeld writes the held output to the terminal unless more output followed meanwhile.
+func (w *inBandWriter) flushHeld(holds int) {
+	w.outMu.Lock()
+	defer w.outMu.Unlock()
+
+	if w.holds != holds || len(w.held) == 0 {
+		return
+	}
+	if _, err := w.out.Write(w.held); err != nil {
+		w.cli.logger.Println("write held output err ", err)
+	}
+	w.held = nil
+}
+
+// start runs the handler of protocol, the remote process is told to cancel when it fails.
+func (w *inBandWriter) start(protocol InBandProtocol) {
+	w.cli.logger.Println("in band transfer started ", protocol)
+	w.cli.showNotice(fmt.Sprintf("%s transfer started, press ctrl-c to cancel", protocol))
+
+	remote := newInBandRemote()
+	ctx, cancel := context.WithCancel(context.Background())
+	w.mu.Lock()
+	w.active = &inBandTransfer{remote: remote, cancel: cancel}
+	w.mu.Unlock()
+
+	input := writerFunc(func(p []byte) (int, error) {
+		w.cli.sendData(append([]byte(nil), p...))
+		return len(p), nil
+	})
+	go func() {
+		defer cancel()
+
+		err := fmt.Errorf("%w: %s", ErrUnsupportedTransfer, protocol)
+		if w.cli.inBandHandler != nil {
+			err = w.cli.inBandHandler.Transfer(ctx, protocol, remote, input)
+		}
+
+		// the output flush goroutine is blocked handing output over meanwhile
+		if err != nil {
+			w.cli.logger.Println("in band transfer failed ", err)
+			w.cli.sendData(inBandAborts[protocol])
+			w.cli.showNotice(fmt.Sprintf("%s transfer failed: %s", protocol, err))
+		} else {
+			w.cli.showNotice(fmt.Sprintf("%s transfer finished", protocol))
+		}
+		w.end(remote)
+	}()
+}
+
+// end writes the output the handler didn't use to the terminal and resumes it.
+func (w *inBandWriter) end(remote *inBandRemote) {
+	w.outMu.Lock()
+	defer w.outMu.Unlock()
+
+	close(remote.done)
+	if leftover := remote.leftover(); len(leftover) > 0 {
+		if _, err := w.out.Write(leftover); err != nil {
+			w.cli.logger.Println("write output after in band transfer err ", err)
+		}
+	}
+	w.mu.Lock()
+	w.active = nil
+	w.mu.Unlock()
+}
+
+// intercept keeps the user input from the remote process during a transfer, ctrl-c cancels it.
+func (w *inBandWriter) intercept(input []byte) bool {
+	t := w.current()
+	if t == nil {
+		return false
+	}
+	if bytes.IndexByte(input, 0x03) >= 0 {
+		t.cancel()
+	}
+	return true
+}
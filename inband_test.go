@@ -0,0 +1,221 @@
+package wsexec
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lixianyang/wsexec/term"
+)
+
+func TestDetectInBand(t *testing.T) {
+	testcases := map[string]struct {
+		output   string
+		index    int
+		protocol InBandProtocol
+		partial  int
+	}{
+		"sz":           {output: "sz a.txt\r\n**\x18B00000000000000\r\x8a\x11", index: 10, protocol: ZmodemReceive},
+		"rz":           {output: "rz\r**\x18B0100000023be50\r\x8a\x11", index: 3, protocol: ZmodemSend},
+		"tsz":          {output: "\x1b7\x07::TRZSZ:TRANSFER:S:1.1.5:0000000000\r\n", index: 3, protocol: TrzszReceive},
+		"trz":          {output: "::TRZSZ:TRANSFER:R:1.1.5:0000000000\r\n", index: 0, protocol: TrzszSend},
+		"trz dir":      {output: "::TRZSZ:TRANSFER:D:1.1.5:0000000000\r\n", index: 0, protocol: TrzszSend},
+		"plain":        {output: "ls -l\r\n", index: -1},
+		"split zmodem": {output: "output**\x18", index: -1, partial: 3},
+		"split trzsz":  {output: "output::TRZSZ:TRA", index: -1, partial: 11},
+		"single star":  {output: "ls *", index: -1},
+	}
+	for k, tc := range testcases {
+		index, protocol := detectInBand([]byte(tc.output))
+		if index != tc.index || protocol != tc.protocol {
+			t.Errorf("%s: expected %d %s, got %d %s", k, tc.index, tc.protocol, index, protocol)
+		}
+		if got := partialInBand([]byte(tc.output)); got != tc.partial {
+			t.Errorf("%s: expected partial %d, got %d", k, tc.partial, got)
+		}
+	}
+}
+
+func TestInBandHeldOutput(t *testing.T) {
+	out := &lockedBuffer{}
+	w := &inBandWriter{out: out}
+	if _, err := w.Write([]byte("prompt **")); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "prompt " {
+		t.Errorf("expected the end of the output held back, got %q", got)
+	}
+
+	// more output before the timeout is checked for a start sequence first
+	if _, err := w.Write([]byte(" next **")); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "prompt ** next " {
+		t.Errorf("expected the held output written with the next output, got %q", got)
+	}
+
+	time.Sleep(4 * inBandHoldTimeout)
+	if got := out.String(); got != "prompt ** next **" {
+		t.Errorf("expected the held output written after the timeout, got %q", got)
+	}
+}
+
+func TestTrzszAction(t *testing.T) {
+	line := string(trzszAction(false))
+	if !strings.HasPrefix(line, "#ACT:") || !strings.HasSuffix(line, "\n") {
+		t.Fatalf("expected an action line, got %q", line)
+	}
+	compressed, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(line, "#ACT:"), "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	action := map[string]interface{}{}
+	if err = json.NewDecoder(z).Decode(&action); err != nil {
+		t.Fatal(err)
+	}
+	if action["confirm"] != false {
+		t.Errorf("expected the transfer to be declined, got %v", action)
+	}
+}
+
+// lockedBuffer is the terminal of the client.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestInBandTransfer(t *testing.T) {
+	const header = "**\x18B00000000000000\r\x8a\x11"
+	testcases := map[string]struct {
+		handler  InBandTransferHandler
+		output   []string
+		input    string
+		expected string
+	}{
+		"handled": {
+			handler: InBandTransferHandlerFunc(func(ctx context.Context, protocol InBandProtocol, remote io.Reader, input io.Writer) error {
+				buf := make([]byte, len(header+"payload"))
+				if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != header+"payload" {
+					t.Errorf("handler read %q %v", buf, err)
+				}
+				_, err := input.Write([]byte("ack"))
+				return err
+			}),
+			// the start sequence is split between two messages
+			output:   []string{"hello **", "\x18B00000000000000\r\x8a\x11payload"},
+			input:    "ack",
+			expected: "hello \r\n[wsexec] zmodem-receive transfer started, press ctrl-c to cancel\r\n\r\n[wsexec] zmodem-receive transfer finished\r\nbye",
+		},
+		"unsupported": {
+			output:   []string{"rz\r**\x18B0100000023be50\r\x8a\x11"},
+			input:    string(inBandAborts[ZmodemSend]),
+			expected: "rz\r\r\n[wsexec] zmodem-send transfer started, press ctrl-c to cancel\r\n\r\n[wsexec] zmodem-send transfer failed: unsupported in band transfer: zmodem-send\r\n**\x18B0100000023be50\r\x8a\x11bye",
+		},
+		"output after the transfer": {
+			// like rz, the command exits once it got the payload and the prompt that follows isn't its
+			handler: InBandTransferHandlerFunc(func(ctx context.Context, protocol InBandProtocol, remote io.Reader, input io.Writer) error {
+				exited := make(chan struct{})
+				var got []byte
+				stdin := writerFunc(func(p []byte) (int, error) {
+					select {
+					case <-exited:
+						return 0, os.ErrClosed
+					default:
+					}
+					got = append(got, p...)
+					if string(got) == header+"payload" {
+						close(exited)
+					}
+					return len(p), nil
+				})
+				copied := make(chan struct{})
+				go func() {
+					defer close(copied)
+					copyRemote(ctx, stdin, remote)
+				}()
+				<-exited
+				_, err := input.Write([]byte("ack"))
+				<-copied
+				return err
+			}),
+			output:   []string{header + "payload"},
+			input:    "ack",
+			expected: "\r\n[wsexec] zmodem-receive transfer started, press ctrl-c to cancel\r\n\r\n[wsexec] zmodem-receive transfer finished\r\nbye",
+		},
+		// trz waits for the action of the client, which declines the transfer
+		"trzsz declined": {
+			output:   []string{"::TRZSZ:TRANSFER:R:1.1.5:0000000000\r\n"},
+			input:    string(inBandAborts[TrzszSend]),
+			expected: "\r\n[wsexec] trzsz-send transfer started, press ctrl-c to cancel\r\n\r\n[wsexec] trzsz-send transfer failed: unsupported in band transfer: trzsz-send\r\n::TRZSZ:TRANSFER:R:1.1.5:0000000000\r\nbye",
+		},
+	}
+	for k, tc := range testcases {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			s := NewServer(conn)
+			go s.Keepalive()
+			for _, output := range tc.output {
+				_, _ = s.Write([]byte(output))
+			}
+			buf := make([]byte, len(tc.input))
+			if _, err = io.ReadFull(s, buf); err != nil || string(buf) != tc.input {
+				t.Errorf("%s: expected input %q, got %q %v", k, tc.input, buf, err)
+			}
+			_, _ = s.Write([]byte("bye"))
+			s.Close(nil)
+			<-s.Done()
+		}))
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &lockedBuffer{}
+		in, _ := io.Pipe()
+		options := []ClientOption{WithClientTTY(term.TTY{In: in, Out: out})}
+		if tc.handler != nil {
+			options = append(options, WithClientInBandTransfer(tc.handler))
+		}
+		if err = NewClient(conn, options...).Run(); err != nil {
+			t.Errorf("%s: %s", k, err)
+		}
+		// the transfer may end after the session
+		for deadline := time.Now().Add(time.Second); out.String() != tc.expected && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := out.String(); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", k, tc.expected, got)
+		}
+		ts.Close()
+	}
+}
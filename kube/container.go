@@ -0,0 +1,74 @@
+package kube
+
+import (
+	"github.com/lixianyang/wsexec"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultContainerAnnotation names the container kubectl execs into when none is given.
+const DefaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// DefaultSidecars are the containers of service meshes and secret injectors ContainerSelector skips
+// by default.
+var DefaultSidecars = []string{"istio-proxy", "linkerd-proxy", "vault-agent", "consul-dataplane", "envoy-sidecar", "cloudsql-proxy"}
+
+// ContainerSelector picks the container of a pod a session goes to when the user didn't name one.
+type ContainerSelector struct {
+	sidecars map[string]bool
+}
+
+type ContainerSelectorOption func(c *ContainerSelector)
+
+// WithContainerSelectorSidecars sets the containers skipped when picking, DefaultSidecars by default.
+func WithContainerSelectorSidecars(names ...string) ContainerSelectorOption {
+	return func(c *ContainerSelector) {
+		c.sidecars = make(map[string]bool, len(names))
+		for _, name := range names {
+			c.sidecars[name] = true
+		}
+	}
+}
+
+func NewContainerSelector(options ...ContainerSelectorOption) *ContainerSelector {
+	c := &ContainerSelector{}
+	WithContainerSelectorSidecars(DefaultSidecars...)(c)
+
+	for _, opt := range options {
+		opt(c)
+	}
+
+	return c
+}
+
+// Select returns the container named by the DefaultContainerAnnotation of pod, else its only
+// container that isn't a sidecar. Otherwise the choice is the user's and the error is a
+// *wsexec.ContainerChoiceError listing the containers of pod.
+func (c *ContainerSelector) Select(pod *corev1.Pod) (string, error) {
+	names := make([]string, 0, len(pod.Spec.Containers))
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+	}
+	if len(names) == 1 {
+		return names[0], nil
+	}
+
+	// like kubectl, an annotation naming no container is ignored
+	if name := pod.Annotations[DefaultContainerAnnotation]; name != "" {
+		for _, n := range names {
+			if n == name {
+				return name, nil
+			}
+		}
+	}
+
+	var candidates []string
+	for _, name := range names {
+		if !c.sidecars[name] {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	return "", &wsexec.ContainerChoiceError{Pod: pod.Name, Containers: names}
+}
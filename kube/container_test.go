@@ -0,0 +1,51 @@
+package kube
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/lixianyang/wsexec"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestContainerSelector(t *testing.T) {
+	testcases := map[string]struct {
+		containers []string
+		annotation string
+		options    []ContainerSelectorOption
+		expected   string
+		choices    []string
+	}{
+		"only container":         {containers: []string{"app"}, expected: "app"},
+		"only sidecar":           {containers: []string{"istio-proxy"}, expected: "istio-proxy"},
+		"skip sidecars":          {containers: []string{"linkerd-proxy", "app", "vault-agent"}, expected: "app"},
+		"default container":      {containers: []string{"app", "worker"}, annotation: "worker", expected: "worker"},
+		"unknown default":        {containers: []string{"app", "worker"}, annotation: "web", choices: []string{"app", "worker"}},
+		"several containers":     {containers: []string{"app", "worker", "istio-proxy"}, choices: []string{"app", "worker", "istio-proxy"}},
+		"configured sidecars":    {containers: []string{"app", "fluent-bit"}, options: []ContainerSelectorOption{WithContainerSelectorSidecars("fluent-bit")}, expected: "app"},
+		"not configured sidecar": {containers: []string{"app", "istio-proxy"}, options: []ContainerSelectorOption{WithContainerSelectorSidecars("fluent-bit")}, choices: []string{"app", "istio-proxy"}},
+	}
+	for k, tc := range testcases {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-1"}}
+		if tc.annotation != "" {
+			pod.Annotations = map[string]string{DefaultContainerAnnotation: tc.annotation}
+		}
+		for _, name := range tc.containers {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+		}
+
+		name, err := NewContainerSelector(tc.options...).Select(pod)
+		var choiceErr *wsexec.ContainerChoiceError
+		if tc.choices != nil {
+			if !errors.As(err, &choiceErr) || choiceErr.Pod != "web-1" || !reflect.DeepEqual(choiceErr.Containers, tc.choices) {
+				t.Errorf("%s: expected choice of %v, got %v", k, tc.choices, err)
+			}
+			continue
+		}
+		if err != nil || name != tc.expected {
+			t.Errorf("%s: expected %s, got %s %v", k, tc.expected, name, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/lixianyang/wsexec"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+var (
+	ErrEphemeralContainersUnsupported = errors.New("ephemeral containers are not supported by the cluster")
+	ErrDebugContainerFailed           = errors.New("debug container failed")
+)
+
+// Debug adds an ephemeral container running image to the pod of target and attaches the session to
+// it with a tty, for images without a shell such as distroless ones. The debug container runs the
+// command of target, the entrypoint of image when it's empty, and shares the process namespace of
+// the container of target when it's set. Ephemeral containers can't be removed, it stays in the pod
+// spec after the session.
+func (e *Executor) Debug(s *wsexec.Server, target wsexec.Target, image string) error {
+	debug, err := e.AddDebugContainer(s.Context(), target, image)
+	if err != nil {
+		return err
+	}
+	// the debug container has been running for a while, its prompt may be gone
+	if err = s.Notify(fmt.Sprintf("attached to debug container %s, press enter if you don't see a prompt", debug.Container)); err != nil {
+		return err
+	}
+	return e.Attach(s.Context(), debug, remotecommand.StreamOptions{
+		Stdin:             s,
+		Stdout:            s,
+		Stderr:            s,
+		Tty:               true,
+		TerminalSizeQueue: s,
+	})
+}
+
+// AddDebugContainer adds an ephemeral container running image to the pod of target, see Debug, and
+// waits until it runs. It returns the target of the debug container. The error wraps
+// ErrDebugContainerFailed when the container can't start, e.g. its image can't be pulled.
+func (e *Executor) AddDebugContainer(ctx context.Context, target wsexec.Target, image string) (wsexec.Target, error) {
+	client, err := e.ClientFor(ctx)
+	if err != nil {
+		return wsexec.Target{}, err
+	}
+
+	name := "debugger-" + utilrand.String(5)
+	container := corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:                     name,
+			Image:                    image,
+			Command:                  target.Command,
+			Stdin:                    true,
+			TTY:                      true,
+			TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		},
+		TargetContainerName: target.Container,
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"ephemeralContainers": []corev1.EphemeralContainer{container},
+		},
+	})
+	if err != nil {
+		return wsexec.Target{}, err
+	}
+
+	// watching before adding the container, so its start isn't missed
+	pods := client.CoreV1().Pods(target.Namespace)
+	w, err := pods.Watch(ctx, metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", target.Pod).String()})
+	if err != nil {
+		return wsexec.Target{}, err
+	}
+	defer w.Stop()
+
+	pod, err := pods.Patch(ctx, target.Pod, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "ephemeralcontainers")
+	if err != nil {
+		// a missing pod has a name in the details, a missing subresource doesn't
+		var status apierrors.APIStatus
+		if apierrors.IsNotFound(err) && errors.As(err, &status) && (status.Status().Details == nil || status.Status().Details.Name == "") {
+			return wsexec.Target{}, ErrEphemeralContainersUnsupported
+		}
+		return wsexec.Target{}, err
+	}
+	// older clusters ignore the pod spec
+	if !hasEphemeralContainer(pod, name) {
+		return wsexec.Target{}, ErrEphemeralContainersUnsupported
+	}
+
+	debug := wsexec.Target{Namespace: target.Namespace, Pod: target.Pod, Container: name}
+	for {
+		if running, err := ephemeralContainerRunning(pod, name); running || err != nil {
+			return debug, err
+		}
+
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return wsexec.Target{}, fmt.Errorf("watch pod %s closed before debug container %s ran", target.Pod, name)
+			}
+			switch event.Type {
+			case watch.Deleted:
+				return wsexec.Target{}, fmt.Errorf("%w: pod %s has been deleted", ErrDebugContainerFailed, target.Pod)
+			case watch.Error:
+				return wsexec.Target{}, apierrors.FromObject(event.Object)
+			}
+			if p, ok := event.Object.(*corev1.Pod); ok && p.Name == target.Pod {
+				pod = p
+			}
+		case <-ctx.Done():
+			return wsexec.Target{}, ctx.Err()
+		}
+	}
+}
+
+func hasEphemeralContainer(pod *corev1.Pod, name string) bool {
+	for _, c := range pod.Spec.EphemeralContainers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ephemeralContainerRunning tells whether the ephemeral container name of pod runs, the error wraps
+// ErrDebugContainerFailed when it won't.
+func ephemeralContainerRunning(pod *corev1.Pod, name string) (bool, error) {
+	for _, status := range pod.Status.EphemeralContainerStatuses {
+		if status.Name != name {
+			continue
+		}
+		switch state := status.State; {
+		case state.Running != nil:
+			return true, nil
+		case state.Terminated != nil:
+			return false, fmt.Errorf("%w: %s exited with %s %s", ErrDebugContainerFailed, name, state.Terminated.Reason, state.Terminated.Message)
+		case state.Waiting != nil && (state.Waiting.Reason == "ImagePullBackOff" || state.Waiting.Reason == "InvalidImageName"):
+			return false, fmt.Errorf("%w: %s %s", ErrDebugContainerFailed, state.Waiting.Reason, state.Waiting.Message)
+		}
+	}
+	return false, nil
+}
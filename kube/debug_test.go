@@ -0,0 +1,91 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lixianyang/wsexec"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAddDebugContainer(t *testing.T) {
+	testcases := map[string]struct {
+		state       corev1.ContainerState
+		unsupported bool
+		err         error
+	}{
+		"running": {
+			state: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		},
+		"image pull failed": {
+			state: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+			err:   ErrDebugContainerFailed,
+		},
+		"unsupported": {
+			unsupported: true,
+			err:         ErrEphemeralContainersUnsupported,
+		},
+	}
+	for k, tc := range testcases {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		}
+		client := fake.NewSimpleClientset(pod)
+		if tc.unsupported {
+			// the pod comes back without the debug container
+			client.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, pod, nil
+			})
+		}
+		e, err := NewExecutor(&rest.Config{}, WithExecutorClientFunc(func(*rest.Config) (kubernetes.Interface, error) {
+			return client, nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the kubelet starts the debug container
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		go func() {
+			for ctx.Err() == nil {
+				p, err := client.CoreV1().Pods("default").Get(ctx, "web-1", metav1.GetOptions{})
+				if err == nil && len(p.Spec.EphemeralContainers) > 0 {
+					p.Status.EphemeralContainerStatuses = []corev1.ContainerStatus{{Name: p.Spec.EphemeralContainers[0].Name, State: tc.state}}
+					_, _ = client.CoreV1().Pods("default").UpdateStatus(ctx, p, metav1.UpdateOptions{})
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		target := wsexec.Target{Namespace: "default", Pod: "web-1", Container: "app", Command: []string{"sh"}}
+		debug, err := e.AddDebugContainer(ctx, target, "busybox")
+		cancel()
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected %v, got %v", k, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", k, err)
+			continue
+		}
+
+		p, _ := client.CoreV1().Pods("default").Get(context.Background(), "web-1", metav1.GetOptions{})
+		c := p.Spec.EphemeralContainers[0]
+		if debug.Container != c.Name || c.Image != "busybox" || c.TargetContainerName != "app" || !reflect.DeepEqual(c.Command, []string{"sh"}) {
+			t.Errorf("%s: unexpected debug container %+v for %+v", k, c, debug)
+		}
+	}
+}
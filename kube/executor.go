@@ -0,0 +1,302 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lixianyang/wsexec"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+var ErrNoIdentity = errors.New("impersonation requires an authenticated identity")
+
+// Executor runs commands in kubernetes containers for wsexec sessions.
+type Executor struct {
+	config      *rest.Config
+	client      kubernetes.Interface
+	impersonate bool
+	shells      []string
+	newClient   func(config *rest.Config) (kubernetes.Interface, error)
+	newStream   func(config *rest.Config, method string, url *url.URL) (remotecommand.Executor, error)
+
+	// mu guards sessions, the number of sessions running per namespace/pod, see StrategyLeastLoaded
+	mu       sync.Mutex
+	sessions map[string]int
+}
+
+type ExecutorOption func(e *Executor)
+
+// WithExecutorImpersonation makes every request on behalf of a session impersonate the identity
+// from the session context, so the apiserver RBAC decides what the user can do and its audit log
+// records the user rather than the gateway. The gateway needs the RBAC permission to impersonate.
+func WithExecutorImpersonation() ExecutorOption {
+	return func(e *Executor) {
+		e.impersonate = true
+	}
+}
+
+// WithExecutorShells sets the shells Executor.Shell tries in order, DefaultShells by default.
+func WithExecutorShells(shells ...string) ExecutorOption {
+	return func(e *Executor) {
+		e.shells = shells
+	}
+}
+
+// WithExecutorClientFunc creates the clientsets with newClient rather than kubernetes.NewForConfig,
+// the one of the config of NewExecutor as well as the impersonating ones of ClientFor, e.g. to
+// return a fake.NewSimpleClientset in tests.
+func WithExecutorClientFunc(newClient func(config *rest.Config) (kubernetes.Interface, error)) ExecutorOption {
+	return func(e *Executor) {
+		e.newClient = newClient
+	}
+}
+
+// WithExecutorStreamFunc creates the executors of the exec and attach streams with newStream
+// rather than remotecommand.NewSPDYExecutor, e.g. to run commands against a fake in tests.
+func WithExecutorStreamFunc(newStream func(config *rest.Config, method string, url *url.URL) (remotecommand.Executor, error)) ExecutorOption {
+	return func(e *Executor) {
+		e.newStream = newStream
+	}
+}
+
+func NewExecutor(config *rest.Config, options ...ExecutorOption) (*Executor, error) {
+	e := &Executor{
+		config: config,
+		shells: DefaultShells,
+		newClient: func(config *rest.Config) (kubernetes.Interface, error) {
+			return kubernetes.NewForConfig(config)
+		},
+		newStream: remotecommand.NewSPDYExecutor,
+	}
+
+	for _, opt := range options {
+		opt(e)
+	}
+
+	client, err := e.newClient(config)
+	if err != nil {
+		return nil, err
+	}
+	e.client = client
+
+	return e, nil
+}
+
+// ConfigFor returns the rest config for requests made on behalf of the session owning ctx.
+func (e *Executor) ConfigFor(ctx context.Context) (*rest.Config, error) {
+	if !e.impersonate {
+		return e.config, nil
+	}
+
+	id := wsexec.IdentityFrom(ctx)
+	if id == nil {
+		return nil, ErrNoIdentity
+	}
+	config := rest.CopyConfig(e.config)
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: id.User,
+		Groups:   id.Groups,
+	}
+	return config, nil
+}
+
+// ClientFor returns the clientset for requests made on behalf of the session owning ctx.
+func (e *Executor) ClientFor(ctx context.Context) (kubernetes.Interface, error) {
+	if !e.impersonate {
+		return e.client, nil
+	}
+
+	config, err := e.ConfigFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return e.newClient(config)
+}
+
+// Stream runs the target command and streams it with options until the command exits.
+func (e *Executor) Stream(ctx context.Context, target wsexec.Target, options remotecommand.StreamOptions) error {
+	return e.stream(ctx, target, "exec", &corev1.PodExecOptions{
+		Stdin:     options.Stdin != nil,
+		Stdout:    options.Stdout != nil,
+		Stderr:    options.Stderr != nil,
+		TTY:       options.Tty,
+		Container: target.Container,
+		Command:   target.Command,
+	}, options)
+}
+
+// Attach streams the running process of the target container with options until it exits, the
+// command of the target is ignored.
+func (e *Executor) Attach(ctx context.Context, target wsexec.Target, options remotecommand.StreamOptions) error {
+	return e.stream(ctx, target, "attach", &corev1.PodAttachOptions{
+		Stdin:     options.Stdin != nil,
+		Stdout:    options.Stdout != nil,
+		Stderr:    options.Stderr != nil,
+		TTY:       options.Tty,
+		Container: target.Container,
+	}, options)
+}
+
+// stream streams the subresource of the target pod, exec or attach, with its params and options.
+func (e *Executor) stream(ctx context.Context, target wsexec.Target, subresource string, params runtime.Object, options remotecommand.StreamOptions) error {
+	config, err := e.ConfigFor(ctx)
+	if err != nil {
+		return err
+	}
+	client, err := e.ClientFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	req := client.CoreV1().RESTClient().Post().
+		Namespace(target.Namespace).
+		Resource("pods").
+		Name(target.Pod).
+		SubResource(subresource)
+	req.VersionedParams(params, scheme.ParameterCodec)
+
+	exec, err := e.newStream(config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	defer e.track(target)()
+	return exec.Stream(options)
+}
+
+// Exec attaches the session to the target command with a tty and returns when the command exits.
+func (e *Executor) Exec(s *wsexec.Server, target wsexec.Target) error {
+	return e.Stream(s.Context(), target, remotecommand.StreamOptions{
+		Stdin:             s,
+		Stdout:            s,
+		Stderr:            s,
+		Tty:               true,
+		TerminalSizeQueue: s,
+	})
+}
+
+// UploadCommand returns the command extracting an upload into dir of the target.
+func UploadCommand(dir string) []string {
+	return []string{"tar", "xmf", "-", "-C", dir}
+}
+
+// DownloadCommand returns the command archiving file or directory p of the target, the archive
+// entries are named after its base name.
+func DownloadCommand(p string) []string {
+	p = path.Clean(p)
+	return []string{"tar", "cf", "-", "-C", path.Dir(p), path.Base(p)}
+}
+
+// Transfer runs the target command, UploadCommand or DownloadCommand, without a tty and streams
+// the archive through t. What the command prints on stderr is added to its error.
+func (e *Executor) Transfer(t *wsexec.Transfer, target wsexec.Target) error {
+	stderr := &bytes.Buffer{}
+	options := remotecommand.StreamOptions{Stderr: stderr}
+	if t.Direction() == wsexec.TransferUpload {
+		options.Stdin = t
+	} else {
+		options.Stdout = t
+	}
+
+	err := e.Stream(t.Context(), target, options)
+	if err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// Logs streams the logs of the target container selected by options, such as Follow, TailLines and
+// SinceTime, until they end or the user stops following them with ctrl-c, see wsexec.Server.DiscardInput.
+// Line feeds are sent as CRLF since there's no tty translating them. It returns nil at the end of the logs.
+func (e *Executor) Logs(s *wsexec.Server, target wsexec.Target, options corev1.PodLogOptions) error {
+	client, err := e.ClientFor(s.Context())
+	if err != nil {
+		return err
+	}
+
+	ctx := s.DiscardInput()
+	options.Container = target.Container
+	stream, err := client.CoreV1().Pods(target.Namespace).GetLogs(target.Pod, &options).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	_, err = io.Copy(wsexec.NewCRLFWriter(s), stream)
+	if ctx.Err() != nil && s.Context().Err() == nil {
+		// stopped by the user, which ends the logs as well
+		return nil
+	}
+	return err
+}
+
+// SelectTargets returns the targets running command in container of the running pods of namespace
+// matching the label selector, sorted by pod name. Without container, containers picks the one of
+// each pod and its *wsexec.ContainerChoiceError is returned for a pod it can't pick one of.
+func (e *Executor) SelectTargets(ctx context.Context, namespace, selector string, containers *ContainerSelector, container string, command []string) ([]wsexec.Target, error) {
+	client, err := e.ClientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []wsexec.Target
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		name := container
+		if name == "" {
+			if name, err = containers.Select(pod); err != nil {
+				return nil, err
+			}
+		}
+		targets = append(targets, wsexec.Target{Namespace: namespace, Pod: pod.Name, Container: name, Command: command})
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Pod < targets[j].Pod
+	})
+	return targets, nil
+}
+
+// FanOut runs the command of every target without a tty and streams their output prefixed with the
+// pod name, followed by the table of exit codes, see wsexec.FanOut. The session is output only, ctrl-c
+// keeps the remaining targets from being started while the running commands finish.
+func (e *Executor) FanOut(s *wsexec.Server, targets []wsexec.Target, options ...wsexec.FanOutOption) error {
+	ctx := s.DiscardInput()
+	return wsexec.NewFanOut(options...).Run(ctx, wsexec.NewCRLFWriter(s), targets,
+		func(ctx context.Context, target wsexec.Target, stdout, stderr io.Writer) error {
+			return e.Stream(ctx, target, remotecommand.StreamOptions{Stdout: stdout, Stderr: stderr})
+		})
+}
+
+// Broadcast attaches the session to the shells of every target with a tty, the input goes to each of
+// them unless toggled off, see wsexec.SessionGroup. It returns when every shell exited.
+func (e *Executor) Broadcast(s *wsexec.Server, targets []wsexec.Target) error {
+	return wsexec.NewSessionGroup(s, targets).Run(func(m *wsexec.GroupMember) error {
+		return e.Stream(s.Context(), m.Target(), remotecommand.StreamOptions{
+			Stdin:             m,
+			Stdout:            m,
+			Stderr:            m,
+			Tty:               true,
+			TerminalSizeQueue: m,
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/lixianyang/wsexec"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestConfigFor(t *testing.T) {
+	id := &wsexec.Identity{User: "alice", Groups: []string{"support"}}
+	testcases := map[string]struct {
+		options     []ExecutorOption
+		id          *wsexec.Identity
+		impersonate rest.ImpersonationConfig
+		err         error
+	}{
+		"without impersonation":           {id: id},
+		"impersonation":                   {options: []ExecutorOption{WithExecutorImpersonation()}, id: id, impersonate: rest.ImpersonationConfig{UserName: "alice", Groups: []string{"support"}}},
+		"no identity":                     {options: []ExecutorOption{WithExecutorImpersonation()}, err: ErrNoIdentity},
+		"anonymous without impersonation": {},
+	}
+	for k, tc := range testcases {
+		config := &rest.Config{Host: "https://127.0.0.1:6443", BearerToken: "gateway"}
+		e, err := NewExecutor(config, tc.options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		if tc.id != nil {
+			ctx = wsexec.WithIdentity(ctx, tc.id)
+		}
+
+		got, err := e.ConfigFor(ctx)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", k, tc.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(got.Impersonate, tc.impersonate) {
+			t.Errorf("%s: expected impersonation %+v, got %+v", k, tc.impersonate, got.Impersonate)
+		}
+		// the gateway's own config is never changed
+		if config.Impersonate.UserName != "" || got.BearerToken != "gateway" {
+			t.Errorf("%s: unexpected configs %+v %+v", k, config, got)
+		}
+		if _, err = e.ClientFor(ctx); err != nil {
+			t.Errorf("%s: client %s", k, err)
+		}
+	}
+}
+
+func TestExecutorClientFunc(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var configs []*rest.Config
+	e, err := NewExecutor(&rest.Config{Host: "https://127.0.0.1:6443"}, WithExecutorImpersonation(),
+		WithExecutorClientFunc(func(config *rest.Config) (kubernetes.Interface, error) {
+			configs = append(configs, config)
+			return client, nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := wsexec.WithIdentity(context.Background(), &wsexec.Identity{User: "alice"})
+	got, err := e.ClientFor(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != client {
+		t.Errorf("expected the client of the func, got %v", got)
+	}
+	// the gateway's client and the impersonating one
+	if len(configs) != 2 || configs[0].Impersonate.UserName != "" || configs[1].Impersonate.UserName != "alice" {
+		t.Errorf("expected the gateway and alice configs, got %+v", configs)
+	}
+}
+
+func TestSelectTargets(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	withContainers := func(pod *corev1.Pod, names ...string) *corev1.Pod {
+		for _, name := range names {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+		}
+		return pod
+	}
+	meshed := []runtime.Object{
+		withContainers(newPod("web-b", web, true), "app", "istio-proxy"),
+		withContainers(newPod("web-a", web, true), "app", "istio-proxy"),
+		withContainers(newPod("db-0", map[string]string{"app": "db"}, true), "db"),
+	}
+	testcases := map[string]struct {
+		objects   []runtime.Object
+		container string
+		expected  []string
+		err       bool
+	}{
+		"sidecars skipped": {objects: meshed, expected: []string{"web-a/app", "web-b/app"}},
+		"named container":  {objects: meshed, container: "istio-proxy", expected: []string{"web-a/istio-proxy", "web-b/istio-proxy"}},
+		"ambiguous": {
+			objects: []runtime.Object{withContainers(newPod("web-a", web, true), "app", "worker")},
+			err:     true,
+		},
+	}
+	for k, tc := range testcases {
+		e := &Executor{client: fake.NewSimpleClientset(tc.objects...)}
+		targets, err := e.SelectTargets(context.Background(), "default", "app=web", NewContainerSelector(), tc.container, []string{"ls"})
+		var choiceErr *wsexec.ContainerChoiceError
+		if tc.err != errors.As(err, &choiceErr) {
+			t.Errorf("%s: expected a container choice error %t, got %v", k, tc.err, err)
+			continue
+		}
+		var got []string
+		for _, target := range targets {
+			got = append(got, target.Pod+"/"+target.Container)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", k, tc.expected, got)
+		}
+	}
+}
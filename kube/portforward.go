@@ -0,0 +1,121 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lixianyang/wsexec"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// portDialer opens a stream pair of the apiserver port forwarding for every connection.
+type portDialer struct {
+	conn      httpstream.Connection
+	port      string
+	requestID int64
+}
+
+func (d *portDialer) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, d.port)
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.FormatInt(atomic.AddInt64(&d.requestID, 1), 10))
+	errorStream, err := d.conn.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("create error stream %w", err)
+	}
+	// nothing is written to the error stream
+	_ = errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := d.conn.CreateStream(headers)
+	if err != nil {
+		_ = errorStream.Reset()
+		return nil, fmt.Errorf("create data stream %w", err)
+	}
+
+	s := &portStream{data: dataStream, errorStream: errorStream, err: make(chan error, 1)}
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		if err == nil && len(message) > 0 {
+			err = errors.New(string(message))
+		}
+		s.err <- err
+	}()
+	return s, nil
+}
+
+// portStream is a forwarded connection, the kubelet reports why it failed on the error stream.
+type portStream struct {
+	data        httpstream.Stream
+	errorStream httpstream.Stream
+	err         chan error
+}
+
+// Read returns the error of the kubelet once the data stream is over, e.g. nothing listens on the port.
+func (s *portStream) Read(p []byte) (int, error) {
+	n, err := s.data.Read(p)
+	if err == io.EOF {
+		if e := <-s.err; e != nil {
+			s.err <- e
+			return n, e
+		}
+		s.err <- nil
+	}
+	return n, err
+}
+
+func (s *portStream) Write(p []byte) (int, error) {
+	return s.data.Write(p)
+}
+
+// CloseWrite tells the kubelet nothing more is sent.
+func (s *portStream) CloseWrite() error {
+	return s.data.Close()
+}
+
+func (s *portStream) Close() error {
+	_ = s.errorStream.Reset()
+	return s.data.Reset()
+}
+
+// Forward relays the connections the client of s accepts to target.Port of the target pod through
+// the apiserver port forwarding, see wsexec.ServeForward, and returns when the session ends.
+func (e *Executor) Forward(s *wsexec.Server, target wsexec.Target) error {
+	config, err := e.ConfigFor(s.Context())
+	if err != nil {
+		return err
+	}
+	client, err := e.ClientFor(s.Context())
+	if err != nil {
+		return err
+	}
+
+	req := client.CoreV1().RESTClient().Post().
+		Namespace(target.Namespace).
+		Resource("pods").
+		Name(target.Pod).
+		SubResource("portforward")
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return err
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", req.URL())
+	conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return fmt.Errorf("upgrade port forward connection %w", err)
+	}
+	defer conn.Close()
+	defer e.track(target)()
+
+	return wsexec.ServeForward(s, &portDialer{conn: conn, port: strconv.Itoa(target.Port)})
+}
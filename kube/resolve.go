@@ -0,0 +1,159 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/lixianyang/wsexec"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var (
+	ErrNoReadyPod      = errors.New("no ready pod")
+	ErrUnknownWorkload = errors.New("unknown workload kind")
+	ErrUnknownStrategy = errors.New("unknown strategy")
+)
+
+// Strategy picks the pod of a workload a session goes to.
+type Strategy string
+
+const (
+	// StrategyRandom picks any ready pod, spreading the sessions.
+	StrategyRandom Strategy = "random"
+	// StrategyFirst picks the ready pod first by name, so sessions keep going to the same pod.
+	StrategyFirst Strategy = "first"
+	// StrategyLeastLoaded picks the ready pod with the fewest sessions of the executor running, the
+	// load of the pod itself isn't known.
+	StrategyLeastLoaded Strategy = "least-loaded"
+)
+
+// Resolve returns the pod of namespace ref refers to. ref is a pod name, deploy/name, sts/name,
+// svc/name or a label selector such as app=web, which is told apart by its = or !. Except for pod
+// names, a ready pod is picked with strategy, random when it's empty. The error wraps ErrNoReadyPod
+// when none is ready, ErrUnknownWorkload or ErrUnknownStrategy when ref or strategy is unknown.
+func (e *Executor) Resolve(ctx context.Context, namespace, ref string, strategy Strategy) (*corev1.Pod, error) {
+	client, err := e.ClientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var selector labels.Selector
+	if strings.ContainsAny(ref, "=!") {
+		if selector, err = labels.Parse(ref); err != nil {
+			return nil, err
+		}
+	} else {
+		kind, name := "pod", ref
+		if i := strings.Index(ref, "/"); i >= 0 {
+			kind, name = ref[:i], ref[i+1:]
+		}
+		switch kind {
+		case "pod", "pods", "po":
+			return client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		case "deploy", "deployment", "deployments":
+			deploy, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if selector, err = metav1.LabelSelectorAsSelector(deploy.Spec.Selector); err != nil {
+				return nil, err
+			}
+		case "sts", "statefulset", "statefulsets":
+			sts, err := client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if selector, err = metav1.LabelSelectorAsSelector(sts.Spec.Selector); err != nil {
+				return nil, err
+			}
+		case "svc", "service", "services":
+			svc, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if len(svc.Spec.Selector) == 0 {
+				return nil, fmt.Errorf("%w: service %s has no selector", ErrNoReadyPod, name)
+			}
+			selector = labels.SelectorFromSet(svc.Spec.Selector)
+		default:
+			return nil, fmt.Errorf("%w %s, expected deploy, sts or svc", ErrUnknownWorkload, kind)
+		}
+	}
+
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	var ready []*corev1.Pod
+	for i := range pods.Items {
+		if podReady(&pods.Items[i]) {
+			ready = append(ready, &pods.Items[i])
+		}
+	}
+	if len(ready) == 0 {
+		return nil, fmt.Errorf("%w matches %s", ErrNoReadyPod, ref)
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].Name < ready[j].Name
+	})
+	return e.pick(ready, strategy)
+}
+
+// pick picks one of pods, sorted by name, with strategy.
+func (e *Executor) pick(pods []*corev1.Pod, strategy Strategy) (*corev1.Pod, error) {
+	switch strategy {
+	case StrategyRandom, "":
+		return pods[rand.Intn(len(pods))], nil
+	case StrategyFirst:
+		return pods[0], nil
+	case StrategyLeastLoaded:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		least := pods[0]
+		for _, pod := range pods[1:] {
+			if e.sessions[pod.Namespace+"/"+pod.Name] < e.sessions[least.Namespace+"/"+least.Name] {
+				least = pod
+			}
+		}
+		return least, nil
+	default:
+		return nil, fmt.Errorf("%w %s, expected random, first or least-loaded", ErrUnknownStrategy, strategy)
+	}
+}
+
+// track counts a session of target until the returned function is called, for StrategyLeastLoaded.
+func (e *Executor) track(target wsexec.Target) func() {
+	key := target.Namespace + "/" + target.Pod
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.sessions == nil {
+		e.sessions = make(map[string]int)
+	}
+	e.sessions[key]++
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.sessions[key]--; e.sessions[key] == 0 {
+			delete(e.sessions, key)
+		}
+	}
+}
+
+// podReady tells whether pod is running, not being deleted and ready.
+func podReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lixianyang/wsexec"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPod(name string, labels map[string]string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestResolve(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	selector := &metav1.LabelSelector{MatchLabels: web}
+	objects := []runtime.Object{
+		newPod("web-a", web, false),
+		newPod("web-b", web, true),
+		newPod("web-c", web, true),
+		newPod("db-0", map[string]string{"app": "db"}, true),
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec:       appsv1.DeploymentSpec{Selector: selector},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       appsv1.StatefulSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec:       corev1.ServiceSpec{Selector: web},
+		},
+	}
+	e := &Executor{client: fake.NewSimpleClientset(objects...)}
+	// web-b runs a session already
+	defer e.track(wsexec.Target{Namespace: "default", Pod: "web-b"})()
+
+	testcases := map[string]struct {
+		ref      string
+		strategy Strategy
+		expected string
+		err      error
+	}{
+		"pod name":              {ref: "web-a", expected: "web-a"},
+		"deployment":            {ref: "deploy/web", strategy: StrategyFirst, expected: "web-b"},
+		"statefulset":           {ref: "sts/db", expected: "db-0"},
+		"service least loaded":  {ref: "svc/web", strategy: StrategyLeastLoaded, expected: "web-c"},
+		"label selector":        {ref: "app=web,tier!=cache", strategy: StrategyFirst, expected: "web-b"},
+		"no ready pod":          {ref: "app=cache", err: ErrNoReadyPod},
+		"unknown workload kind": {ref: "job/web", err: ErrUnknownWorkload},
+		"unknown strategy":      {ref: "deploy/web", strategy: "busiest", err: ErrUnknownStrategy},
+	}
+	for k, tc := range testcases {
+		pod, err := e.Resolve(context.Background(), "default", tc.ref, tc.strategy)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected %v, got %v", k, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", k, err)
+		} else if pod.Name != tc.expected {
+			t.Errorf("%s: expected %s, got %s", k, tc.expected, pod.Name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lixianyang/wsexec"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+var ErrNoShell = errors.New("no shell found")
+
+// DefaultShells are the shells Executor.Shell tries, bash isn't in every image, e.g. alpine has ash.
+var DefaultShells = []string{"bash", "ash", "sh"}
+
+// shellScript sets the terminal type of the web terminal and a UTF-8 locale unless the image has
+// one, then replaces itself with the shell, which is $0.
+const shellScript = `export TERM=xterm-256color; [ -n "$LANG" ] || export LANG=C.UTF-8; exec "$0"`
+
+// Shell attaches the session to the first shell of the target container in the chain of
+// WithExecutorShells, ignoring the command of target, and tells the client which one it is.
+func (e *Executor) Shell(s *wsexec.Server, target wsexec.Target) error {
+	shell, err := e.DetectShell(s.Context(), target)
+	if err != nil {
+		return err
+	}
+	if err = s.Notify("using shell " + shell); err != nil {
+		return err
+	}
+	target.Command = ShellCommand(shell)
+	return e.Exec(s, target)
+}
+
+// DetectShell returns the first shell of the chain of WithExecutorShells the target container
+// has, running ShellProbeCommand of each until one isn't missing. The error wraps ErrNoShell when
+// none is there.
+func (e *Executor) DetectShell(ctx context.Context, target wsexec.Target) (string, error) {
+	for _, shell := range e.shells {
+		target.Command = ShellProbeCommand(shell)
+		stderr := &bytes.Buffer{}
+		err := e.Stream(ctx, target, remotecommand.StreamOptions{Stderr: stderr})
+		if err == nil {
+			return shell, nil
+		}
+		if !executableNotFound(err) {
+			return "", fmt.Errorf("try shell %s %w", shell, err)
+		}
+	}
+	return "", fmt.Errorf("%w in container %s, tried %s", ErrNoShell, target.Container, strings.Join(e.shells, ", "))
+}
+
+// ShellCommand returns the command running shell with TERM and the locale set, see shellScript.
+// Executor.Shell runs it, so it's the command line to authorize along with ShellProbeCommand.
+func ShellCommand(shell string) []string {
+	return []string{shell, "-c", shellScript, shell}
+}
+
+// ShellProbeCommand returns the command DetectShell runs to tell whether the container has shell.
+func ShellProbeCommand(shell string) []string {
+	return []string{shell, "-c", "exit 0"}
+}
+
+// executableNotFound tells whether an exec failed with err because its executable is missing. The
+// container runtimes report it as an error or as the exit status of the shell convention.
+func executableNotFound(err error) bool {
+	var exitErr interface{ ExitStatus() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus() == 126 || exitErr.ExitStatus() == 127
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "executable file not found") || strings.Contains(msg, "no such file or directory")
+}
@@ -0,0 +1,96 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lixianyang/wsexec"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+func TestExecutableNotFound(t *testing.T) {
+	testcases := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"runc": {
+			err:      errors.New(`OCI runtime exec failed: exec failed: container_linux.go:380: starting container process caused: exec: "bash": executable file not found in $PATH: unknown`),
+			expected: true,
+		},
+		"crun":           {err: errors.New(`executable file "bash" not found: no such file or directory`), expected: true},
+		"exit status":    {err: exec.CodeExitError{Err: errors.New("command terminated with exit code 127"), Code: 127}, expected: true},
+		"shell failed":   {err: exec.CodeExitError{Err: errors.New("command terminated with exit code 1"), Code: 1}},
+		"pod not found":  {err: errors.New(`pods "web-1" not found`)},
+		"connection err": {err: errors.New("error dialing backend: dial tcp 10.0.0.1:10250: i/o timeout")},
+	}
+	for k, tc := range testcases {
+		if got := executableNotFound(tc.err); got != tc.expected {
+			t.Errorf("%s: expected %t, got %t", k, tc.expected, got)
+		}
+	}
+}
+
+// fakeStream runs exec commands by their name, the result of a missing name is exit code 127.
+type fakeStream struct {
+	command []string
+	results map[string]error
+}
+
+func (f *fakeStream) Stream(options remotecommand.StreamOptions) error {
+	if err, ok := f.results[f.command[0]]; ok {
+		return err
+	}
+	return exec.CodeExitError{Err: errors.New("command terminated with exit code 127"), Code: 127}
+}
+
+func TestDetectShell(t *testing.T) {
+	dialErr := errors.New("error dialing backend")
+	testcases := map[string]struct {
+		results  map[string]error
+		shell    string
+		tried    []string
+		err      error
+		errShell string
+	}{
+		"bash":          {results: map[string]error{"bash": nil, "sh": nil}, shell: "bash", tried: []string{"bash"}},
+		"falls back":    {results: map[string]error{"ash": nil, "sh": nil}, shell: "ash", tried: []string{"bash", "ash"}},
+		"last":          {results: map[string]error{"sh": nil}, shell: "sh", tried: []string{"bash", "ash", "sh"}},
+		"no shell":      {tried: []string{"bash", "ash", "sh"}, err: ErrNoShell},
+		"runtime error": {results: map[string]error{"bash": errors.New(`exec: "bash": executable file not found in $PATH`), "ash": nil}, shell: "ash", tried: []string{"bash", "ash"}},
+		"other error":   {results: map[string]error{"bash": dialErr, "sh": nil}, tried: []string{"bash"}, err: dialErr, errShell: "bash"},
+	}
+	for k, tc := range testcases {
+		var tried []string
+		newStream := func(config *rest.Config, method string, u *url.URL) (remotecommand.Executor, error) {
+			command := u.Query()["command"]
+			if !reflect.DeepEqual(command, ShellProbeCommand(command[0])) {
+				t.Errorf("%s: expected the probe command, got %q", k, command)
+			}
+			tried = append(tried, command[0])
+			return &fakeStream{command: command, results: tc.results}, nil
+		}
+		e, err := NewExecutor(&rest.Config{Host: "https://127.0.0.1:6443"}, WithExecutorStreamFunc(newStream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shell, err := e.DetectShell(context.Background(), wsexec.Target{Namespace: "default", Pod: "web-1", Container: "app"})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", k, tc.err, err)
+		}
+		if tc.errShell != "" && (err == nil || !strings.Contains(err.Error(), tc.errShell)) {
+			t.Errorf("%s: expected the error to name shell %s, got %v", k, tc.errShell, err)
+		}
+		if shell != tc.shell {
+			t.Errorf("%s: expected shell %q, got %q", k, tc.shell, shell)
+		}
+		if !reflect.DeepEqual(tried, tc.tried) {
+			t.Errorf("%s: expected shells %q to be tried, got %q", k, tc.tried, tried)
+		}
+	}
+}
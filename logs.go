@@ -0,0 +1,66 @@
+package wsexec
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// An output only session shows output without a remote process reading input, such as container
+// logs. The server drops the input except for ctrl-c and ctrl-d, which stop following the output,
+// and ends the session with a nil error at the end of the output so the client sees exit status 0.
+
+// DiscardInput drops the input of an output only session until it ends. The returned context is
+// canceled once the session ends or the user typed ctrl-c or ctrl-d.
+func (s *Server) DiscardInput() context.Context {
+	ctx, cancel := context.WithCancel(s.ctx)
+	go func() {
+		defer cancel()
+
+		// keep reading after ctrl-c, credit granted by the client is only seen while the input flows
+		buf := make([]byte, 1024)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				return
+			}
+			if bytes.ContainsAny(buf[:n], "\x03"+EndOfTransmission) {
+				s.logger.Println("output only session interrupted by the user")
+				cancel()
+			}
+		}
+	}()
+	return ctx
+}
+
+// crlfWriter writes line feeds as CRLF, as a tty would, for output that doesn't come from one.
+type crlfWriter struct {
+	w io.Writer
+}
+
+// NewCRLFWriter returns a writer translating line feeds written to w to CRLF, so that output without
+// a tty such as logs shows in a raw terminal.
+func NewCRLFWriter(w io.Writer) io.Writer {
+	return &crlfWriter{w: w}
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Logs shows the output of an output only session, such as the one of kube.Executor.Logs, until it
+// ends. The terminal is left as it is and no input is sent, it returns nil at the end of the output.
+func (cli *Client) Logs() error {
+	go cli.send()
+	if cli.outputWindow.size > 0 {
+		if err := cli.grantCredit(cli.outputWindow.size); err != nil {
+			return err
+		}
+	}
+	go cli.flushOut(cli.tty.Out)
+
+	return cli.result(<-cli.errChan)
+}
@@ -0,0 +1,67 @@
+package wsexec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/lixianyang/wsexec/term"
+)
+
+func TestLogs(t *testing.T) {
+	testcases := map[string]struct {
+		logs     []string
+		input    string
+		expected string
+	}{
+		"end of logs": {
+			logs:     []string{"line 1\nline", " 2\n"},
+			expected: "line 1\r\nline 2\r\n",
+		},
+		"stopped following": {
+			logs:     []string{"line 1\n"},
+			input:    "\x03",
+			expected: "line 1\r\n",
+		},
+	}
+	for k, tc := range testcases {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			s := NewServer(conn)
+			go s.Keepalive()
+			ctx := s.DiscardInput()
+			out := NewCRLFWriter(s)
+			for _, line := range tc.logs {
+				_, _ = out.Write([]byte(line))
+			}
+			if tc.input != "" {
+				// following until the user stops it
+				<-ctx.Done()
+			}
+			s.Close(nil)
+			<-s.Done()
+		}))
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &lockedBuffer{}
+		cli := NewClient(conn, WithClientTTY(term.TTY{Out: out}))
+		if tc.input != "" {
+			go cli.sendData([]byte(tc.input))
+		}
+		if err = cli.Logs(); err != nil {
+			t.Errorf("%s: %s", k, err)
+		}
+		if got := out.String(); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", k, tc.expected, got)
+		}
+		ts.Close()
+	}
+}
@@ -19,9 +19,53 @@ type payloadType int
 
 var (
 	terminalSizeChangeType payloadType = websocket.TextMessage
+	controlType            payloadType = websocket.TextMessage
 	dataType               payloadType = websocket.BinaryMessage
 )
 
+type controlKind string
+
+const (
+	// controlNotice carries a human readable message the client shows in its terminal.
+	controlNotice controlKind = "notice"
+	// controlCredit grants the peer credit to send more data, see flowcontrol.go.
+	controlCredit controlKind = "credit"
+	// controlExit carries the exit status of the remote process right before the close message.
+	controlExit controlKind = "exit"
+	// controlChecksum ends the archive of a transfer with its size and sha256, see transfer.go.
+	controlChecksum controlKind = "checksum"
+	// controlInfo carries the pod a session was resolved to, such as a pod of a deployment, see Server.Info.
+	controlInfo controlKind = "info"
+)
+
+// control is the payload of a control message.
+type control struct {
+	Kind    controlKind `json:"kind"`
+	Message string      `json:"message,omitempty"`
+	Credit  int64       `json:"credit,omitempty"`
+	// ExitCode is a pointer, 0 is a meaningful exit status
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// Namespace, Pod and Container are the target of an info message
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+// noticeLine returns a notice on its own line, the terminal may be in raw mode so the line ends with CRLF.
+func noticeLine(message string) string {
+	return "\r\n[wsexec] " + message + "\r\n"
+}
+
+func marshalControl(c control) ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func unmarshalControl(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
 type message struct {
 	Type payloadType
 	Data []byte
@@ -34,6 +78,13 @@ func newTerminalSizeChangeMessage(data []byte) message {
 	}
 }
 
+func newControlMessage(data []byte) message {
+	return message{
+		Type: controlType,
+		Data: data,
+	}
+}
+
 func newDataMessage(data []byte) message {
 	return message{
 		Type: dataType,
@@ -45,6 +96,6 @@ func isDataType(t int) bool {
 	return t == int(dataType)
 }
 
-func isTerminalSizeChangeType(t int) bool {
-	return t == int(terminalSizeChangeType)
+func isControlType(t int) bool {
+	return t == int(controlType)
 }
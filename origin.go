@@ -0,0 +1,77 @@
+package wsexec
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRFTokenQueryParam carries the csrf token, browsers can't set headers on websocket requests.
+const CSRFTokenQueryParam = "csrf_token"
+
+var (
+	ErrOriginNotAllowed = errors.New("origin not allowed")
+	ErrInvalidCSRFToken = errors.New("invalid csrf token")
+)
+
+// checkOrigin allows requests without an Origin header, which browsers always send, requests from
+// the same host, and requests from an origin matching one of the allowed patterns such as
+// "https://*.example.com". Everything else, including the "null" origin, is rejected.
+func checkOrigin(r *http.Request, allowedOrigins []string) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%w: malformed origin %q", ErrOriginNotAllowed, origin)
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, pattern := range allowedOrigins {
+		if globMatch(strings.ToLower(pattern), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrOriginNotAllowed, origin)
+}
+
+// CSRFToken returns the csrf token bound to the value of the session cookie, render it into the page
+// opening the websocket and pass it back in the CSRFTokenQueryParam query parameter.
+func CSRFToken(key []byte, sessionValue string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sessionValue))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRFToken verifies the csrf token of r against the session cookie, a cross site page can make
+// the browser send the cookie but can't read it to compute the token. Only browsers are exposed to
+// cross site requests and they always send the Origin header, requests without one aren't checked.
+func checkCSRFToken(r *http.Request, key []byte, cookieName string) error {
+	if r.Header.Get("Origin") == "" {
+		return nil
+	}
+
+	cookie, err := r.Cookie(cookieName)
+	if err != nil || cookie.Value == "" {
+		return fmt.Errorf("%w: missing session cookie %s", ErrInvalidCSRFToken, cookieName)
+	}
+
+	token := r.URL.Query().Get(CSRFTokenQueryParam)
+	if token == "" {
+		return fmt.Errorf("%w: missing %s query parameter", ErrInvalidCSRFToken, CSRFTokenQueryParam)
+	}
+	if !hmac.Equal([]byte(token), []byte(CSRFToken(key, cookie.Value))) {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package wsexec
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := []string{"https://console.example.com", "https://*.Tools.example.com"}
+	testcases := map[string]struct {
+		origin string
+		err    error
+	}{
+		"no origin":              {},
+		"same host":              {origin: "https://gateway.example.com"},
+		"same host other case":   {origin: "https://GATEWAY.example.com"},
+		"same host other scheme": {origin: "http://gateway.example.com"},
+		"other port":             {origin: "https://gateway.example.com:8443", err: ErrOriginNotAllowed},
+		"allowed":                {origin: "https://console.example.com"},
+		"allowed other case":     {origin: "HTTPS://Console.Example.com"},
+		"allowed glob":           {origin: "https://grafana.tools.example.com"},
+		"glob other scheme":      {origin: "http://grafana.tools.example.com", err: ErrOriginNotAllowed},
+		"glob suffix":            {origin: "https://tools.example.com.evil.com", err: ErrOriginNotAllowed},
+		"not allowed":            {origin: "https://evil.com", err: ErrOriginNotAllowed},
+		"null":                   {origin: "null", err: ErrOriginNotAllowed},
+		"malformed":              {origin: "://", err: ErrOriginNotAllowed},
+	}
+	for k, tc := range testcases {
+		r := httptest.NewRequest(http.MethodGet, "https://gateway.example.com/exec", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if err := checkOrigin(r, allowed); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", k, tc.err, err)
+		}
+	}
+}
+
+func TestCheckCSRFToken(t *testing.T) {
+	key := []byte("csrf key")
+	testcases := map[string]struct {
+		origin string
+		cookie string
+		token  string
+		err    error
+	}{
+		"valid":            {origin: "https://gateway.example.com", cookie: "session-1", token: CSRFToken(key, "session-1")},
+		"no origin":        {},
+		"missing cookie":   {origin: "https://gateway.example.com", token: CSRFToken(key, "session-1"), err: ErrInvalidCSRFToken},
+		"missing token":    {origin: "https://gateway.example.com", cookie: "session-1", err: ErrInvalidCSRFToken},
+		"forged cookie":    {origin: "https://gateway.example.com", cookie: "session-2", token: CSRFToken(key, "session-1"), err: ErrInvalidCSRFToken},
+		"forged token":     {origin: "https://gateway.example.com", cookie: "session-1", token: "0123456789abcdef", err: ErrInvalidCSRFToken},
+		"signed other key": {origin: "https://gateway.example.com", cookie: "session-1", token: CSRFToken([]byte("other key"), "session-1"), err: ErrInvalidCSRFToken},
+	}
+	for k, tc := range testcases {
+		target := "https://gateway.example.com/exec"
+		if tc.token != "" {
+			target += "?" + CSRFTokenQueryParam + "=" + tc.token
+		}
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "session", Value: tc.cookie})
+		}
+		if err := checkCSRFToken(r, key, "session"); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", k, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package wsexec
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleNoticeInterval is the minimum interval between two throttling notices of a session.
+const throttleNoticeInterval = 30 * time.Second
+
+// NewByteRateLimiter returns a token bucket allowing bytesPerSecond bytes per second with bursts of
+// up to burst bytes, burst defaults to bytesPerSecond when it's not positive. It doesn't limit
+// anything when bytesPerSecond isn't positive.
+func NewByteRateLimiter(bytesPerSecond, burst int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// throttle delays a byte stream until every limiter allows it, limiters may be shared by sessions.
+type throttle struct {
+	limiters []*rate.Limiter
+
+	mu         sync.Mutex
+	lastNotice time.Time
+}
+
+func (t *throttle) add(limiter *rate.Limiter) {
+	t.limiters = append(t.limiters, limiter)
+}
+
+// wait blocks until n bytes are allowed to pass and returns how long it waited. A limiter with a
+// finite limit and no burst never lets anything pass, it fails with ErrRateLimiterNoBurst.
+func (t *throttle) wait(ctx context.Context, n int) (time.Duration, error) {
+	if len(t.limiters) == 0 || n == 0 {
+		return 0, nil
+	}
+
+	start := time.Now()
+	for _, limiter := range t.limiters {
+		if limiter.Limit() == rate.Inf {
+			continue
+		}
+		if limiter.Burst() <= 0 {
+			return 0, ErrRateLimiterNoBurst
+		}
+		// WaitN fails when asked for more than the burst, wait chunk by chunk
+		for remaining := n; remaining > 0; {
+			chunk := remaining
+			if burst := limiter.Burst(); chunk > burst {
+				chunk = burst
+			}
+			if err := limiter.WaitN(ctx, chunk); err != nil {
+				return time.Since(start), err
+			}
+			remaining -= chunk
+		}
+	}
+	return time.Since(start), nil
+}
+
+// shouldNotice reports whether the user should be told about throttling after waiting for waited.
+func (t *throttle) shouldNotice(waited time.Duration, now time.Time) bool {
+	if waited < 100*time.Millisecond {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastNotice) < throttleNoticeInterval {
+		return false
+	}
+	t.lastNotice = now
+	return true
+}
@@ -0,0 +1,80 @@
+package wsexec
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestThrottleWait(t *testing.T) {
+	testcases := map[string]struct {
+		limiters []*rate.Limiter
+		n        int
+		ctx      func() (context.Context, context.CancelFunc)
+		min      time.Duration
+		err      error
+	}{
+		"no limiter":              {n: 1 << 20},
+		"unlimited without burst": {limiters: []*rate.Limiter{rate.NewLimiter(rate.Inf, 0)}, n: 1 << 20},
+		"no rate":                 {limiters: []*rate.Limiter{NewByteRateLimiter(0, 0)}, n: 1 << 20},
+		"no burst":                {limiters: []*rate.Limiter{rate.NewLimiter(1000, 0)}, n: 10, err: ErrRateLimiterNoBurst},
+		"within burst":            {limiters: []*rate.Limiter{NewByteRateLimiter(1000, 0)}, n: 1000},
+		// the burst passes at once, the remaining 200 bytes take 200ms
+		"chunked":     {limiters: []*rate.Limiter{NewByteRateLimiter(1000, 100)}, n: 300, min: 150 * time.Millisecond},
+		"every limit": {limiters: []*rate.Limiter{NewByteRateLimiter(1<<20, 0), NewByteRateLimiter(1000, 100)}, n: 300, min: 150 * time.Millisecond},
+		"canceled": {
+			limiters: []*rate.Limiter{NewByteRateLimiter(10, 10)},
+			n:        100,
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(50*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			min: 50 * time.Millisecond,
+			err: context.Canceled,
+		},
+	}
+	for k, tc := range testcases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if tc.ctx != nil {
+			cancel()
+			ctx, cancel = tc.ctx()
+		}
+		th := &throttle{}
+		for _, limiter := range tc.limiters {
+			th.add(limiter)
+		}
+
+		waited, err := th.wait(ctx, tc.n)
+		cancel()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", k, tc.err, err)
+		}
+		if waited < tc.min || waited > tc.min+time.Second {
+			t.Errorf("%s: expected to wait about %s, waited %s", k, tc.min, waited)
+		}
+	}
+}
+
+func TestThrottleShouldNotice(t *testing.T) {
+	th := &throttle{}
+	now := time.Now()
+	steps := []struct {
+		waited   time.Duration
+		after    time.Duration
+		expected bool
+	}{
+		{waited: 10 * time.Millisecond},
+		{waited: time.Second, expected: true},
+		{waited: time.Second, after: 10 * time.Second},
+		{waited: time.Second, after: 31 * time.Second, expected: true},
+	}
+	for i, step := range steps {
+		if got := th.shouldNotice(step.waited, now.Add(step.after)); got != step.expected {
+			t.Errorf("step %d: expected %t, got %t", i, step.expected, got)
+		}
+	}
+}
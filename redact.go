@@ -0,0 +1,131 @@
+package wsexec
+
+import (
+	"bytes"
+	"regexp"
+	"sync/atomic"
+)
+
+const redactedMask = "******"
+
+// DefaultRedactionPatterns mask common credentials: assignments of passwords, tokens and keys,
+// bearer tokens, JWTs, AWS access keys and PEM private keys.
+var DefaultRedactionPatterns = []string{
+	`(?i)((?:password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key)["']?\s*[:=]\s*["']?)[^\s"']+`,
+	`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`,
+	`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`,
+	`AKIA[0-9A-Z]{16}`,
+	`(-----BEGIN [A-Z ]*PRIVATE KEY-----)[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
+
+// DefaultPasswordPrompt matches output asking for a secret, the input answering it isn't echoed
+// by the remote terminal and is never recorded.
+const DefaultPasswordPrompt = `(?i)\b(password|passphrase|pass phrase|passcode|pin|secret|token)\b[^\r\n]{0,40}:\s*$`
+
+// Redactor masks secrets in recorded input and output and in audit logs, the session stream
+// itself is never modified.
+type Redactor struct {
+	patterns []*regexp.Regexp
+	prompt   *regexp.Regexp
+}
+
+// NewRedactor returns a Redactor masking patterns, the first group of a pattern is kept so that
+// `(password=)\S+` records "password=******". prompt matches output after which the next line of
+// input is a secret, DefaultPasswordPrompt is used when it's empty.
+func NewRedactor(patterns []string, prompt string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	if prompt == "" {
+		prompt = DefaultPasswordPrompt
+	}
+	re, err := regexp.Compile(prompt)
+	if err != nil {
+		return nil, err
+	}
+	r.prompt = re
+
+	return r, nil
+}
+
+// NewDefaultRedactor returns a Redactor with DefaultRedactionPatterns and DefaultPasswordPrompt.
+func NewDefaultRedactor() *Redactor {
+	r, err := NewRedactor(DefaultRedactionPatterns, DefaultPasswordPrompt)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Redact returns data with every match of the patterns masked.
+func (r *Redactor) Redact(data []byte) []byte {
+	if r == nil {
+		return data
+	}
+	for _, re := range r.patterns {
+		data = re.ReplaceAll(data, []byte("${1}"+redactedMask))
+	}
+	return data
+}
+
+// RedactString is Redact for strings.
+func (r *Redactor) RedactString(s string) string {
+	return string(r.Redact([]byte(s)))
+}
+
+// isPrompt reports whether output ends asking for a secret.
+func (r *Redactor) isPrompt(output []byte) bool {
+	return r != nil && r.prompt.Match(output)
+}
+
+// secretInput follows the output of a session to know when the input is a secret nobody should
+// see, the remote terminal usually turns echo off meanwhile.
+type secretInput struct {
+	// state is accessed atomically
+	state int32
+}
+
+const (
+	secretNone int32 = iota
+	// secretArmed follows a password prompt until the first input
+	secretArmed
+	// secretMasked follows the first input of the secret until the end of the line
+	secretMasked
+)
+
+// observeOutput arms the secret input after a password prompt.
+func (s *secretInput) observeOutput(r *Redactor, output []byte) {
+	if r.isPrompt(output) {
+		atomic.StoreInt32(&s.state, secretArmed)
+	}
+}
+
+// filterInput returns what may be recorded of input. A secret is recorded as a single mask,
+// the input may come a keystroke at a time and its length is a secret too.
+func (s *secretInput) filterInput(r *Redactor, input []byte) []byte {
+	if r == nil {
+		return input
+	}
+	state := atomic.LoadInt32(&s.state)
+	if state == secretNone {
+		return r.Redact(input)
+	}
+
+	var recorded []byte
+	if state == secretArmed {
+		recorded = []byte(redactedMask)
+	}
+	// enter, ctrl-c and ctrl-d end the secret
+	if i := bytes.IndexAny(input, "\r\n\x03\x04"); i >= 0 {
+		atomic.StoreInt32(&s.state, secretNone)
+		return append(recorded, input[i:]...)
+	}
+	atomic.StoreInt32(&s.state, secretMasked)
+	return recorded
+}
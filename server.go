@@ -1,6 +1,7 @@
 package wsexec
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,21 +10,48 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
 type Server struct {
 	conn         *websocket.Conn
+	ctx          context.Context
+	cancel       context.CancelFunc
 	resizeChan   chan remotecommand.TerminalSize
 	doneChan     chan error
+	done         chan struct{}
+	readDone     chan struct{}
 	ticker       *time.Ticker
 	pingInterval time.Duration
 	pingTimeout  time.Duration
 	closeTimeout time.Duration
-	sync.Mutex   // write lock
+	writeTimeout time.Duration
+	readLimit    int64
+	compression  compression
+	codec        codec
+	timeouts     sessionTimeouts
+	inputLimit   throttle
+	outputLimit  throttle
+	inputWindow  recvWindow
+	outputWindow *sendWindow
+	inputChan    chan []byte
+	// pending is the part of the last input not returned by Read yet, only accessed by Read
+	pending []byte
+	// inputEOF is set by Read once the client ended its input, see controlChecksum
+	inputEOF bool
+	// readErr is returned by Read once inputChan is closed
+	readErr    error
+	sync.Mutex // write lock
+	// closeErr is the error the server closed the session with, guarded by the write lock
+	closeErr error
+	// peerChecksum is the checksum the client sent at the end of an upload, guarded by the write lock
+	peerChecksum *control
 	logger       Logger
 	debugInput   io.Writer
 	debugOutput  io.Writer
+	redactor     *Redactor
+	secret       secretInput
 }
 
 type ServerOption func(s *Server)
@@ -46,6 +74,100 @@ func WithServerCloseTimeout(d time.Duration) ServerOption {
 	}
 }
 
+// WithServerContext sets the parent of the session context, it carries values such as the Identity.
+func WithServerContext(ctx context.Context) ServerOption {
+	return func(s *Server) {
+		s.ctx = ctx
+	}
+}
+
+// WithServerWriteTimeout fails the session with ErrWriteTimeout when writing a data or control
+// message takes longer than d, so a stuck client can't block the remote process output forever.
+// There's no timeout by default.
+func WithServerWriteTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithServerReadLimit sets the maximum size in bytes of a message from the client, the session
+// is closed with websocket.CloseMessageTooBig when it's exceeded.
+func WithServerReadLimit(limit int64) ServerOption {
+	return func(s *Server) {
+		s.readLimit = limit
+	}
+}
+
+// WithServerCompression compresses messages of at least threshold bytes with the compress/flate
+// level, when the client negotiated permessage-deflate. The upgrader must have EnableCompression
+// set, see WithSessionManagerCompression. threshold defaults to DefaultCompressionThreshold.
+func WithServerCompression(level, threshold int) ServerOption {
+	return func(s *Server) {
+		s.compression = newCompression(level, threshold)
+	}
+}
+
+// WithServerMaxDuration closes the session with CloseSessionExpired once it has lasted d.
+func WithServerMaxDuration(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeouts.maxDuration = d
+	}
+}
+
+// WithServerIdleTimeout closes the session with CloseSessionIdle when there's neither input nor output for d.
+func WithServerIdleTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeouts.idleTimeout = d
+	}
+}
+
+// WithServerTimeoutWarning sets how long before a timeout the user is warned in the terminal, at most
+// half the idle timeout before it.
+func WithServerTimeoutWarning(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeouts.warning = d
+	}
+}
+
+// WithServerFlowControl grants the client window bytes of input credit, so at most window bytes
+// of input are buffered while the remote process doesn't read them. Output is flow controlled
+// whenever the client grants credit, see WithClientFlowControl. Clients must support flow control.
+func WithServerFlowControl(window int) ServerOption {
+	return func(s *Server) {
+		s.inputWindow.size = int64(window)
+	}
+}
+
+// WithServerOutputRateLimit throttles the output of the session to bytesPerSecond, see NewByteRateLimiter.
+func WithServerOutputRateLimit(bytesPerSecond, burst int) ServerOption {
+	return func(s *Server) {
+		s.outputLimit.add(NewByteRateLimiter(bytesPerSecond, burst))
+	}
+}
+
+// WithServerInputRateLimit throttles the input of the session to bytesPerSecond, see NewByteRateLimiter.
+func WithServerInputRateLimit(bytesPerSecond, burst int) ServerOption {
+	return func(s *Server) {
+		s.inputLimit.add(NewByteRateLimiter(bytesPerSecond, burst))
+	}
+}
+
+// WithServerOutputLimiter throttles the output of the session with limiter as well,
+// pass the same limiter to several sessions to limit their overall output.
+func WithServerOutputLimiter(limiter *rate.Limiter) ServerOption {
+	return func(s *Server) {
+		s.outputLimit.add(limiter)
+	}
+}
+
+// WithServerInputLimiter throttles the input of the session with limiter as well,
+// pass the same limiter to several sessions to limit their overall input.
+func WithServerInputLimiter(limiter *rate.Limiter) ServerOption {
+	return func(s *Server) {
+		s.inputLimit.add(limiter)
+	}
+}
+
 func WithServerLogger(logger Logger) ServerOption {
 	return func(s *Server) {
 		s.logger = logger
@@ -64,39 +186,117 @@ func WithServerDebugOutput(writer io.Writer) ServerOption {
 	}
 }
 
+// WithServerRedactor sets the redactor applied to the debug input and output, by default it's
+// NewDefaultRedactor, pass nil to record everything including passwords.
+func WithServerRedactor(r *Redactor) ServerOption {
+	return func(s *Server) {
+		s.redactor = r
+	}
+}
+
 func NewServer(conn *websocket.Conn, options ...ServerOption) *Server {
 	defaultPingInterval := 10 * time.Second
 	defaultPingTimeout := 5 * time.Second
 	defaultCloseTimeout := 5 * time.Second
+	defaultTimeoutWarning := time.Minute
+	defaultReadLimit := int64(1 << 20)
 	defaultLogger := discardLogger{}
 
 	s := &Server{
 		conn:         conn,
+		ctx:          context.Background(),
 		resizeChan:   make(chan remotecommand.TerminalSize, 1),
 		doneChan:     make(chan error, 2),
+		done:         make(chan struct{}),
+		readDone:     make(chan struct{}),
+		outputWindow: newSendWindow(),
+		inputChan:    make(chan []byte, 16),
 		pingInterval: defaultPingInterval,
 		pingTimeout:  defaultPingTimeout,
 		closeTimeout: defaultCloseTimeout,
+		readLimit:    defaultReadLimit,
+		timeouts:     sessionTimeouts{warning: defaultTimeoutWarning},
 		logger:       defaultLogger,
+		redactor:     NewDefaultRedactor(),
 	}
 
 	for _, opt := range options {
 		opt(s)
 	}
 
+	s.codec = codecFor(s.conn.Subprotocol())
+	s.conn.SetReadLimit(s.readLimit)
+	if err := s.compression.apply(s.conn); err != nil {
+		s.logger.Println("set compression level err ", err)
+	}
+	s.ctx, s.cancel = context.WithCancel(s.ctx)
 	s.ticker = time.NewTicker(s.pingInterval)
+	s.timeouts.start(time.Now())
 
 	return s
 }
 
 func (s *Server) Close(err error) {
 	s.logger.Println("close with err=", err)
-	s.doneChan <- err
+	s.finish(err)
+}
+
+// abort closes the connection right away, it fails a write blocked on a client that stopped reading.
+func (s *Server) abort() {
+	if err := s.conn.Close(); err != nil {
+		s.logger.Println("abort connection err ", err)
+	}
+}
+
+// Context returns the session context, it's canceled when the session has ended.
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+// Done returns a channel that's closed when the session has ended and the connection is closed.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Notify shows message in the client terminal without going through the remote process.
+func (s *Server) Notify(message string) error {
+	return s.writeControl(control{Kind: controlNotice, Message: message})
+}
+
+// Info tells the client the session goes to target, e.g. the pod picked for a deployment. The client
+// shows it like a notice.
+func (s *Server) Info(target Target) error {
+	return s.writeControl(control{
+		Kind:      controlInfo,
+		Message:   fmt.Sprintf("connected to pod %s/%s container %s", target.Namespace, target.Pod, target.Container),
+		Namespace: target.Namespace,
+		Pod:       target.Pod,
+		Container: target.Container,
+	})
+}
+
+// finish hands err to the keepalive goroutine, it never blocks after the session has ended.
+func (s *Server) finish(err error) {
+	select {
+	case s.doneChan <- err:
+	case <-s.done:
+	}
 }
 
 func (s *Server) Keepalive() {
+	defer close(s.done)
+	defer s.cancel()
 	defer s.conn.Close()
 
+	go s.readLoop()
+
+	var timeoutC <-chan time.Time
+	if s.timeouts.enabled() {
+		timeoutTicker := time.NewTicker(time.Second)
+		defer timeoutTicker.Stop()
+		timeoutC = timeoutTicker.C
+	}
+
 	var err error
 	for {
 		select {
@@ -106,33 +306,99 @@ func (s *Server) Keepalive() {
 				s.logger.Println("keepalive goroutine returned with ping err ", err)
 				return
 			}
+		case now := <-timeoutC:
+			warning, err := s.timeouts.check(now)
+			if err != nil {
+				s.logger.Println("keepalive goroutine returned with timeout err ", err)
+				if s.sendCloseMessageIfNeeded(err) {
+					s.awaitClose()
+				}
+				return
+			}
+			if warning != "" {
+				s.logger.Println("send timeout warning ", warning)
+				if err = s.Notify(warning); err != nil {
+					s.logger.Println("send timeout warning err ", err)
+				}
+			}
 		case err = <-s.doneChan:
 			s.logger.Println("keepalive goroutine returned with done err=", err)
-			s.sendCloseMessageIfNeeded(err)
+			if s.sendCloseMessageIfNeeded(err) {
+				s.awaitClose()
+			}
 			return
 		}
 	}
 }
 
-func (s *Server) sendCloseMessageIfNeeded(err error) {
-	if err == nil {
-		return
+// sendCloseMessageIfNeeded sends the close message for err and reports whether it was sent.
+func (s *Server) sendCloseMessageIfNeeded(err error) bool {
+	if err == io.EOF {
+		s.logger.Println("needn't send close message, the client ended the session")
+		return false
 	}
-
 	if e, ok := err.(*websocket.CloseError); ok {
 		s.logger.Printfln("needn't send close message with websocket close error code %d message %s", e.Code, e.Text)
-		return
+		return false
+	}
+	if errors.Is(err, websocket.ErrReadLimit) {
+		s.logger.Println("needn't send close message, the connection sent it when the read limit was exceeded")
+		return false
 	}
 
-	s.logger.Println("send close message with err ", err)
-	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, err.Error())
 	s.Lock()
 	defer s.Unlock()
+
+	// the exit status goes first so that the client knows it before the connection is closed
+	if code, ok := exitStatus(err); ok {
+		s.logger.Println("send exit status ", code)
+		if e := s.writeExitStatus(code, err); e != nil {
+			s.logger.Println("send exit status err ", e)
+		}
+	}
+
+	s.logger.Println("send close message with err ", err)
+	var closeMessage []byte
+	if err == nil {
+		closeMessage = websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	} else {
+		closeMessage = websocket.FormatCloseMessage(closeCode(err), err.Error())
+		s.closeErr = err
+	}
 	if e := s.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(s.closeTimeout)); e != nil {
 		s.logger.Println("send close message with write control err ", e)
+		return false
+	}
+	return true
+}
+
+// awaitClose gives the client the close timeout to answer the close message, closing the connection
+// right away could reset it before the client has read everything sent before.
+func (s *Server) awaitClose() {
+	timer := time.NewTimer(s.closeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.readDone:
+	case <-timer.C:
+		s.logger.Println("client didn't answer the close message within ", s.closeTimeout)
 	}
+}
 
-	return
+// writeExitStatus writes the exit control message within the close timeout, the caller holds the lock.
+func (s *Server) writeExitStatus(code int, exitErr error) error {
+	c := control{Kind: controlExit, ExitCode: &code}
+	if exitErr != nil {
+		c.Message = exitErr.Error()
+	}
+	m, ok, err := s.codec.encodeControl(c)
+	if err != nil || !ok {
+		return err
+	}
+	if err = s.conn.SetWriteDeadline(time.Now().Add(s.closeTimeout)); err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(int(m.Type), m.Data)
 }
 
 func (s *Server) Ping() error {
@@ -142,90 +408,320 @@ func (s *Server) Ping() error {
 	return s.conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(s.pingTimeout))
 }
 
-func (s *Server) Read(p []byte) (n int, err error) {
-	var t int
-	var data []byte
+// Read returns the input of the client, it implements the stdin of the remote process.
+func (s *Server) Read(p []byte) (int, error) {
+	if s.inputEOF {
+		return 0, io.EOF
+	}
+	if len(s.pending) == 0 {
+		data, ok := <-s.inputChan
+		if !ok {
+			return 0, s.readErr
+		}
+		if data == nil {
+			s.inputEOF = true
+			return 0, io.EOF
+		}
+		s.pending = data
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	s.consumeInput(n)
+	return n, nil
+}
+
+// readMessage returns the next input message whole, for sessions framing their input such as port
+// forwarding. It mustn't be mixed with Read and grants no credit, see consumeInput.
+func (s *Server) readMessage() ([]byte, error) {
+	data, ok := <-s.inputChan
+	if !ok {
+		return nil, s.readErr
+	}
+	return data, nil
+}
+
+// consumeInput grants the client credit for n bytes of input once it's worth it.
+func (s *Server) consumeInput(n int) {
+	if credit := s.inputWindow.consume(n); credit > 0 {
+		if err := s.writeControl(control{Kind: controlCredit, Credit: credit}); err != nil {
+			s.logger.Println("grant input credit err ", err)
+		}
+	}
+}
+
+// readLoop reads messages from the connection until it fails. Input is queued for Read, while
+// resize and control messages are handled right away, so credit granted by the client is seen
+// even if the remote process doesn't read its input.
+func (s *Server) readLoop() {
+	defer close(s.readDone)
+	defer close(s.inputChan)
+
+	if err := s.greet(); err != nil {
+		s.logger.Println("send greeting err ", err)
+	}
+	if s.inputWindow.size > 0 {
+		if err := s.writeControl(control{Kind: controlCredit, Credit: s.inputWindow.size}); err != nil {
+			s.logger.Println("grant initial input credit err ", err)
+		}
+	}
+
+	var err error
 	for {
+		var t int
+		var data []byte
 		t, data, err = s.conn.ReadMessage()
 		if err != nil {
 			break
 		}
 
-		if isTerminalSizeChangeType(t) {
-			s.logger.Println("read terminal size change message: ", string(data))
-			size := remotecommand.TerminalSize{}
-			if err = unmarshalTerminalSize(data, &size); err != nil {
-				s.logger.Println("unmarshal terminal size message err ", err)
+		var f frame
+		if f, err = s.codec.decode(t, data); err != nil {
+			break
+		}
+
+		if f.control != nil {
+			s.handleControl(*f.control)
+		}
+		if f.reply != nil {
+			if err = s.writeMessage(int(f.reply.Type), f.reply.Data); err != nil {
 				break
 			}
-			s.resizeChan <- size
-			continue
 		}
-
-		if isDataType(t) {
-			s.recordInput(data)
-			n = copy(p, data)
-			break
+		if f.size != nil {
+			if err = s.resize(*f.size); err != nil {
+				break
+			}
+		}
+		if len(f.input) > 0 {
+			s.timeouts.touch(time.Now())
+			if err = s.wait(&s.inputLimit, len(f.input), "input"); err != nil {
+				break
+			}
+			s.recordInput(f.input)
+			select {
+			case s.inputChan <- f.input:
+			case <-s.done:
+				s.readErr = io.EOF
+				return
+			}
 		}
-
-		err = ErrUnexpectedMessageType
-	}
-
-	if err == nil || err == io.EOF {
-		return
 	}
 
+	var cleanup bool
 	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 		s.logger.Println("silence websocket normal close")
 		err = io.EOF
 	} else if errors.Is(err, net.ErrClosed) {
 		s.logger.Println("silence ", net.ErrClosed)
 		err = io.EOF
+		cleanup = s.closedByServer()
 	} else {
 		if e, ok := err.(*websocket.CloseError); ok {
 			s.logger.Printfln("silence websocket close error with code: %d message: %s", e.Code, e.Text)
 			err = io.EOF
 		}
+		cleanup = true
+	}
+
+	if cleanup {
 		s.logger.Println("cleanup remote session with ", EndOfTransmission, "(EOT)")
-		n = copy(p, EndOfTransmission)
+		select {
+		case s.inputChan <- []byte(EndOfTransmission):
+		case <-s.done:
+		}
 	}
 
-	if err == io.EOF {
-		s.doneChan <- nil
-	} else {
-		s.doneChan <- err
+	s.readErr = err
+	s.finish(err)
+}
+
+// greet sends the greeting of the protocol.
+func (s *Server) greet() error {
+	messages, err := s.codec.greeting()
+	if err != nil {
+		return err
 	}
+	for _, m := range messages {
+		if err = s.writeMessage(int(m.Type), m.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return
+func (s *Server) handleControl(c control) {
+	switch c.Kind {
+	case controlCredit:
+		s.outputWindow.grant(c.Credit)
+	case controlChecksum:
+		s.Lock()
+		s.peerChecksum = &c
+		s.Unlock()
+		// the checksum ends the uploaded archive, Read returns io.EOF once it's read
+		select {
+		case s.inputChan <- nil:
+		case <-s.done:
+		}
+	default:
+		s.logger.Printfln("ignore unknown control message kind %s", c.Kind)
+	}
 }
 
-func (s *Server) Write(p []byte) (n int, err error) {
-	s.Lock()
-	defer s.Unlock()
+// resize validates a terminal size change and queues it for Next.
+func (s *Server) resize(size remotecommand.TerminalSize) error {
+	s.logger.Println("read terminal size change message: ", size)
+	if size.Width == 0 || size.Height == 0 {
+		// e.g. a browser terminal fitted into a hidden element, keep the current size
+		s.logger.Println("ignore empty terminal size ", size)
+		return nil
+	}
+	if size.Width > MaxTerminalWidth || size.Height > MaxTerminalHeight {
+		return fmt.Errorf("%w: terminal size %dx%d exceeds %dx%d", ErrMalformedMessage, size.Width, size.Height, MaxTerminalWidth, MaxTerminalHeight)
+	}
+	// only the latest size matters, replace a pending one nobody has asked for yet
+	select {
+	case s.resizeChan <- size:
+	default:
+		select {
+		case <-s.resizeChan:
+		default:
+		}
+		s.resizeChan <- size
+	}
+	return nil
+}
+
+// Write sends output to the client, it implements the stdout and stderr of the remote process.
+// It blocks while the client hasn't granted credit, so a slow client slows down the remote process.
+func (s *Server) Write(p []byte) (int, error) {
+	return s.writeOutput(nil, p)
+}
+
+// writeOutput sends p within the output credit, every message starts with header which isn't counted as output.
+func (s *Server) writeOutput(header, p []byte) (n int, err error) {
+	// throttled output is delayed rather than dropped, the remote process blocks meanwhile
+	if err = s.wait(&s.outputLimit, len(p), "output"); err != nil {
+		return 0, err
+	}
+
+	for n < len(p) {
+		var size int
+		if size, err = s.outputWindow.acquire(s.ctx, len(p)-n); err != nil {
+			s.logger.Println("acquire output credit err ", err)
+			return n, err
+		}
+		if err = s.writeData(header, p[n:n+size]); err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
 
-	if err = s.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+func (s *Server) writeData(header, p []byte) (err error) {
+	data := p
+	if header != nil {
+		data = append(append(make([]byte, 0, len(header)+len(p)), header...), p...)
+	}
+	m := s.codec.encodeOutput(data)
+	if err = s.writeMessage(int(m.Type), m.Data); err != nil {
 		s.logger.Println("write err ", err)
 	}
 
+	s.timeouts.touch(time.Now())
 	s.recordOutput(p)
-	return len(p), err
+	return err
+}
+
+func (s *Server) writeControl(c control) error {
+	m, ok, err := s.codec.encodeControl(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.logger.Printfln("drop %s control message the protocol can't carry", c.Kind)
+		return nil
+	}
+
+	return s.writeMessage(int(m.Type), m.Data)
+}
+
+// writeMessage writes a message within the write timeout, a timed out write breaks the connection
+// so the session is ended with ErrWriteTimeout.
+func (s *Server) writeMessage(messageType int, data []byte) error {
+	err := s.write(messageType, data)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = fmt.Errorf("%w: %s", ErrWriteTimeout, err)
+		// the write error is sticky, every writer ends up here, and finish may block until the
+		// keepalive goroutine, which takes the lock to close the session, is done
+		s.finish(err)
+	}
+	return err
+}
+
+// write writes a message with the write lock held.
+func (s *Server) write(messageType int, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.writeTimeout > 0 {
+		if err := s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+			return err
+		}
+	}
+
+	s.compression.beforeWrite(s.conn, len(data))
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// wait blocks until the throttle lets n bytes pass, and tells the user the direction is throttled.
+func (s *Server) wait(t *throttle, n int, direction string) error {
+	waited, err := t.wait(s.ctx, n)
+	if err != nil {
+		s.logger.Println("wait ", direction, " rate limit err ", err)
+		return err
+	}
+	if t.shouldNotice(waited, time.Now()) {
+		s.logger.Println(direction, " throttled for ", waited)
+		if err = s.Notify(direction + " is being throttled by the session rate limit"); err != nil {
+			s.logger.Println("send throttle notice err ", err)
+		}
+	}
+	return nil
+}
+
+// closedByServer reports whether the server ended the session, e.g. on timeout or shutdown.
+func (s *Server) closedByServer() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.closeErr != nil
 }
 
 func (s *Server) Next() *remotecommand.TerminalSize {
 	select {
 	case size := <-s.resizeChan:
 		return &size
+	case <-s.done:
+		return nil
 	}
 }
 
 func (s *Server) recordInput(data []byte) {
 	if s.debugInput != nil {
-		_, _ = s.debugInput.Write([]byte(fmt.Sprintf("%+q\n", data)))
+		if data = s.secret.filterInput(s.redactor, data); len(data) > 0 {
+			_, _ = s.debugInput.Write([]byte(fmt.Sprintf("%+q\n", data)))
+		}
 	}
 }
 
 func (s *Server) recordOutput(data []byte) {
+	if s.debugInput != nil {
+		s.secret.observeOutput(s.redactor, data)
+	}
 	if s.debugOutput != nil {
-		_, _ = s.debugOutput.Write(data)
+		_, _ = s.debugOutput.Write(s.redactor.Redact(data))
 	}
 }
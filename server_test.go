@@ -0,0 +1,153 @@
+package wsexec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServerWriteTimeout(t *testing.T) {
+	timeouts := make(chan int, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s := NewServer(conn, WithServerWriteTimeout(50*time.Millisecond), WithServerPingInterval(10*time.Millisecond))
+		go s.Keepalive()
+
+		// every writer times out once the client stops reading, the first timeout is sticky
+		chunk := bytes.Repeat([]byte("x"), 64*1024)
+		var wg sync.WaitGroup
+		var n int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := s.Write(chunk); err != nil {
+						if errors.Is(err, ErrWriteTimeout) {
+							atomic.AddInt32(&n, 1)
+						}
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		<-s.Done()
+		timeouts <- int(atomic.LoadInt32(&n))
+	}))
+	defer ts.Close()
+
+	// the client never reads
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case n := <-timeouts:
+		if n <= 2 {
+			t.Errorf("expected every writer to time out, %d did", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the session to end with a write timeout")
+	}
+}
+
+// recordingConn records what's read from the connection.
+type recordingConn struct {
+	net.Conn
+	read bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Write(p[:n])
+	return n, err
+}
+
+// closeFrames returns the payloads of the close frames among the unmasked frames in data.
+func closeFrames(data []byte) [][]byte {
+	var frames [][]byte
+	for len(data) >= 2 {
+		opcode, length, header := data[0]&0x0f, int(data[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, header = int(binary.BigEndian.Uint16(data[2:])), 4
+		case 127:
+			length, header = int(binary.BigEndian.Uint64(data[2:])), 10
+		}
+		if len(data) < header+length {
+			break
+		}
+		if opcode == websocket.CloseMessage {
+			frames = append(frames, data[header:header+length])
+		}
+		data = data[header+length:]
+	}
+	return frames
+}
+
+func TestServerReadLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s := NewServer(conn, WithServerReadLimit(1024))
+		go s.Keepalive()
+		_, _ = io.Copy(ioutil.Discard, s)
+		<-s.Done()
+	}))
+	defer ts.Close()
+
+	var recorded *recordingConn
+	dialer := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		recorded = &recordingConn{Conn: conn}
+		return recorded, err
+	}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err = conn.WriteMessage(websocket.BinaryMessage, bytes.Repeat([]byte("x"), 2048)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expected close code %d, got %v", websocket.CloseMessageTooBig, err)
+	}
+
+	// everything the server sent until it closed the connection
+	_ = recorded.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.Copy(ioutil.Discard, recorded)
+	data := recorded.read.Bytes()
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		data = data[i+4:]
+	}
+	if frames := closeFrames(data); len(frames) != 1 {
+		t.Errorf("expected a single close frame, got %d", len(frames))
+	}
+}
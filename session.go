@@ -0,0 +1,440 @@
+package wsexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SessionManager upgrades http requests to websocket sessions and keeps track of them,
+// so they can be drained when the server shuts down.
+type SessionManager struct {
+	upgrader       websocket.Upgrader
+	serverOptions  []ServerOption
+	authenticator  Authenticator
+	authorizer     Authorizer
+	allowedOrigins []string
+	csrfKey        []byte
+	csrfCookie     string
+	noticeInterval time.Duration
+	logger         Logger
+	auditLogger    Logger
+	redactor       *Redactor
+	compress       bool
+	subprotocols   []string
+
+	mu       sync.Mutex
+	sessions map[*Server]struct{}
+	closing  bool
+	// notifying are the sessions still sending the last shutdown notice
+	notifying map[*Server]bool
+	// drained is closed once the manager is closing and every session ended
+	drained     chan struct{}
+	drainedOnce sync.Once
+}
+
+type SessionManagerOption func(m *SessionManager)
+
+// WithSessionManagerUpgrader sets the websocket upgrader, the origin check of the session manager
+// replaces CheckOrigin unless it's set.
+func WithSessionManagerUpgrader(upgrader websocket.Upgrader) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.upgrader = upgrader
+	}
+}
+
+// WithSessionManagerServerOptions sets the options applied to every Server created by Upgrade.
+func WithSessionManagerServerOptions(options ...ServerOption) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.serverOptions = append(m.serverOptions, options...)
+	}
+}
+
+// WithSessionManagerAuthenticator sets the authenticator run before every upgrade,
+// requests it rejects get 401 and never reach the websocket handshake.
+func WithSessionManagerAuthenticator(authenticator Authenticator) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.authenticator = authenticator
+	}
+}
+
+// WithSessionManagerAuthorizer sets the authorizer consulted by Authorize.
+func WithSessionManagerAuthorizer(authorizer Authorizer) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.authorizer = authorizer
+	}
+}
+
+// WithSessionManagerAllowedOrigins allows browsers on other origins matching one of the patterns,
+// such as "https://console.example.com" or "https://*.example.com", to open sessions.
+// By default only pages served from the same host can.
+func WithSessionManagerAllowedOrigins(origins ...string) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.allowedOrigins = append(m.allowedOrigins, origins...)
+	}
+}
+
+// WithSessionManagerCSRF requires browser requests to carry the CSRFToken of the cookieName
+// cookie signed with key in the CSRFTokenQueryParam query parameter.
+func WithSessionManagerCSRF(key []byte, cookieName string) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.csrfKey = key
+		m.csrfCookie = cookieName
+	}
+}
+
+// WithSessionManagerOutputRateLimit limits the overall output of all sessions to bytesPerSecond,
+// use WithServerOutputRateLimit in the server options to limit each session.
+func WithSessionManagerOutputRateLimit(bytesPerSecond, burst int) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.serverOptions = append(m.serverOptions, WithServerOutputLimiter(NewByteRateLimiter(bytesPerSecond, burst)))
+	}
+}
+
+// WithSessionManagerInputRateLimit limits the overall input of all sessions to bytesPerSecond,
+// use WithServerInputRateLimit in the server options to limit each session.
+func WithSessionManagerInputRateLimit(bytesPerSecond, burst int) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.serverOptions = append(m.serverOptions, WithServerInputLimiter(NewByteRateLimiter(bytesPerSecond, burst)))
+	}
+}
+
+// WithSessionManagerCompression negotiates permessage-deflate with clients supporting it and
+// compresses messages of at least threshold bytes with the compress/flate level, see WithServerCompression.
+func WithSessionManagerCompression(level, threshold int) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.compress = true
+		m.serverOptions = append(m.serverOptions, WithServerCompression(level, threshold))
+	}
+}
+
+// WithSessionManagerSubprotocols lets clients negotiate the protocols besides the wsexec protocol,
+// e.g. KubernetesSubprotocols, the first of them the client asks for is chosen.
+func WithSessionManagerSubprotocols(protocols ...string) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.subprotocols = append(m.subprotocols, protocols...)
+	}
+}
+
+// WithSessionManagerNoticeInterval sets how often the shutdown countdown is sent to clients, with 0
+// it is sent once.
+func WithSessionManagerNoticeInterval(d time.Duration) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.noticeInterval = d
+	}
+}
+
+func WithSessionManagerLogger(logger Logger) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.logger = logger
+	}
+}
+
+// WithSessionManagerAuditLogger sets the logger recording who started and ended which session.
+func WithSessionManagerAuditLogger(logger Logger) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.auditLogger = logger
+	}
+}
+
+// WithSessionManagerRedactor sets the redactor applied to audit logs, such as commands carrying
+// passwords, by default it's NewDefaultRedactor.
+func WithSessionManagerRedactor(r *Redactor) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.redactor = r
+	}
+}
+
+func NewSessionManager(options ...SessionManagerOption) *SessionManager {
+	defaultNoticeInterval := 10 * time.Second
+	defaultLogger := discardLogger{}
+
+	m := &SessionManager{
+		noticeInterval: defaultNoticeInterval,
+		logger:         defaultLogger,
+		auditLogger:    defaultLogger,
+		redactor:       NewDefaultRedactor(),
+		sessions:       make(map[*Server]struct{}),
+		drained:        make(chan struct{}),
+	}
+
+	for _, opt := range options {
+		opt(m)
+	}
+
+	if m.compress {
+		m.upgrader.EnableCompression = true
+	}
+	m.upgrader.Subprotocols = append(m.upgrader.Subprotocols, m.subprotocols...)
+	if m.upgrader.CheckOrigin == nil {
+		m.upgrader.CheckOrigin = func(r *http.Request) bool {
+			return checkOrigin(r, m.allowedOrigins) == nil
+		}
+	}
+
+	return m
+}
+
+// Authenticate checks the origin and csrf token of the request, then runs the authenticator and
+// returns a shallow copy of r whose context carries the identity, call it first when the handler
+// does some work before Upgrade. Requests that fail get 403 or 401 and the error is returned.
+func (m *SessionManager) Authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	if err := m.checkCrossSite(r); err != nil {
+		m.audit("reject cross site request remote=%s path=%s err=%s", r.RemoteAddr, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, err
+	}
+
+	if m.authenticator == nil || IdentityFrom(r.Context()) != nil {
+		return r, nil
+	}
+
+	id, err := m.authenticator.Authenticate(r)
+	if err == nil && (id == nil || id.User == "") {
+		err = fmt.Errorf("%w: empty identity", ErrUnauthenticated)
+	}
+	if err != nil {
+		m.audit("reject unauthenticated request remote=%s path=%s err=%s", r.RemoteAddr, r.URL.Path, err)
+		http.Error(w, ErrUnauthenticated.Error(), http.StatusUnauthorized)
+		return nil, err
+	}
+
+	return r.WithContext(WithIdentity(r.Context(), id)), nil
+}
+
+func (m *SessionManager) checkCrossSite(r *http.Request) error {
+	if err := checkOrigin(r, m.allowedOrigins); err != nil {
+		return err
+	}
+	if m.csrfKey != nil {
+		return checkCSRFToken(r, m.csrfKey, m.csrfCookie)
+	}
+	return nil
+}
+
+// Authorize checks whether the identity of r may exec into target and returns a shallow copy of r
+// whose context carries the target. Denied requests get 403 with the reason and the error is returned.
+// It must be called after Authenticate and before Upgrade.
+func (m *SessionManager) Authorize(w http.ResponseWriter, r *http.Request, target Target) (*http.Request, error) {
+	if m.authorizer != nil {
+		id := IdentityFrom(r.Context())
+		if err := m.authorizer.Authorize(r.Context(), id, target); err != nil {
+			m.audit("reject unauthorized request user=%s remote=%s target=%s err=%s", auditUser(id), r.RemoteAddr, target, err)
+			if !errors.Is(err, ErrForbidden) {
+				http.Error(w, "authorize error", http.StatusInternalServerError)
+				return nil, err
+			}
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return nil, err
+		}
+	}
+
+	return r.WithContext(WithTarget(r.Context(), target)), nil
+}
+
+// Upgrade authenticates the request if it hasn't been yet, upgrades it to a websocket connection
+// and returns the Server of the new session, the identity is available from the server context
+// with IdentityFrom. With an authorizer configured the request must have passed Authorize. After Shutdown has been called it replies 503 and returns ErrSessionManagerClosed.
+func (m *SessionManager) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Server, error) {
+	m.mu.Lock()
+	closing := m.closing
+	m.mu.Unlock()
+	if closing {
+		http.Error(w, ErrSessionManagerClosed.Error(), http.StatusServiceUnavailable)
+		return nil, ErrSessionManagerClosed
+	}
+
+	r, err := m.Authenticate(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := TargetFrom(r.Context()); m.authorizer != nil && !ok {
+		err = fmt.Errorf("%w: session target hasn't been authorized", ErrForbidden)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, err
+	}
+
+	conn, err := m.upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	options := append([]ServerOption{WithServerContext(r.Context())}, m.serverOptions...)
+	s := NewServer(conn, options...)
+
+	m.mu.Lock()
+	if m.closing {
+		m.mu.Unlock()
+		s.sendCloseMessageIfNeeded(ErrServerGoingAway)
+		_ = conn.Close()
+		return nil, ErrSessionManagerClosed
+	}
+	m.sessions[s] = struct{}{}
+	m.mu.Unlock()
+
+	target, _ := TargetFrom(r.Context())
+	m.audit("session started user=%s remote=%s path=%s target=%s", auditUser(IdentityFrom(r.Context())), r.RemoteAddr, r.URL.Path, target)
+	go m.track(s)
+
+	return s, nil
+}
+
+func (m *SessionManager) audit(format string, a ...interface{}) {
+	m.auditLogger.Println(m.redactor.RedactString(fmt.Sprintf(format, a...)))
+}
+
+func auditUser(id *Identity) string {
+	if id == nil {
+		return "anonymous"
+	}
+	return id.String()
+}
+
+// Len returns the number of active sessions.
+func (m *SessionManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.sessions)
+}
+
+func (m *SessionManager) track(s *Server) {
+	start := time.Now()
+	<-s.Done()
+	m.audit("session ended user=%s duration=%s", auditUser(IdentityFrom(s.Context())), time.Since(start).Round(time.Millisecond))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, s)
+	m.checkDrained()
+}
+
+// checkDrained closes drained once the manager is closing and no session is left, the caller holds mu.
+func (m *SessionManager) checkDrained() {
+	if m.closing && len(m.sessions) == 0 {
+		m.drainedOnce.Do(func() {
+			close(m.drained)
+		})
+	}
+}
+
+// Shutdown stops accepting new sessions and tells every client the server is going away,
+// with a countdown when ctx has a deadline. It waits for the sessions to end on their own
+// until ctx is done, then closes the remaining ones with websocket.CloseGoingAway, waits for
+// them to finish within twice their close timeout, closes the connections of those that didn't,
+// such as a client that stopped reading, and returns ctx.Err(). It may be called several times,
+// concurrently as well. The sessions must be running Keepalive.
+func (m *SessionManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	m.checkDrained()
+	m.mu.Unlock()
+
+	m.logger.Println("shutdown with active sessions ", m.Len())
+
+	// without an interval the notice is sent once
+	var tickC <-chan time.Time
+	if m.noticeInterval > 0 {
+		ticker := time.NewTicker(m.noticeInterval)
+		defer ticker.Stop()
+		tickC = ticker.C
+	}
+
+	m.notifyAll(shutdownNotice(ctx))
+	for {
+		select {
+		case <-m.drained:
+			m.logger.Println("shutdown completed, all sessions finished")
+			return nil
+		case <-tickC:
+			m.notifyAll(shutdownNotice(ctx))
+		case <-ctx.Done():
+			m.logger.Println("shutdown deadline exceeded, close remaining sessions ", m.Len())
+			m.closeAll()
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *SessionManager) snapshot() []*Server {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := make([]*Server, 0, len(m.sessions))
+	for s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// notifyAll sends message to every session without waiting, as a client that stopped reading blocks
+// the writes to its session. A session still sending the previous notice is skipped.
+func (m *SessionManager) notifyAll(message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.notifying == nil {
+		m.notifying = make(map[*Server]bool)
+	}
+	for s := range m.sessions {
+		if m.notifying[s] {
+			continue
+		}
+		m.notifying[s] = true
+		go func(s *Server) {
+			if err := s.Notify(message); err != nil {
+				m.logger.Println("send shutdown notice err ", err)
+			}
+			m.mu.Lock()
+			delete(m.notifying, s)
+			m.mu.Unlock()
+		}(s)
+	}
+}
+
+// closeAll closes every session and waits for them to end. Each of them sends the close message and
+// waits for the answer within its close timeout, the connections still open after twice the longest
+// one are closed right away.
+func (m *SessionManager) closeAll() {
+	sessions := m.snapshot()
+	var closeTimeout time.Duration
+	for _, s := range sessions {
+		if s.closeTimeout > closeTimeout {
+			closeTimeout = s.closeTimeout
+		}
+		// Close blocks while the keepalive goroutine is stuck on a write
+		go s.Close(ErrServerGoingAway)
+	}
+
+	timer := time.NewTimer(2 * closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-m.drained:
+		return
+	case <-timer.C:
+	}
+	m.logger.Println("close the connections of remaining sessions ", m.Len())
+	for _, s := range m.snapshot() {
+		s.abort()
+	}
+	<-m.drained
+}
+
+func shutdownNotice(ctx context.Context) string {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return "server is going away, please finish your work and exit the session"
+	}
+
+	remaining := time.Until(deadline).Round(time.Second)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return fmt.Sprintf("server is going away, this session will be closed in %s", remaining)
+}
@@ -0,0 +1,204 @@
+package wsexec
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newManagedSession serves sessions of m until they end and dials one.
+func newManagedSession(t *testing.T, m *SessionManager) (*httptest.Server, *websocket.Conn) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := m.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s.Keepalive()
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upgrade returns before the session is tracked
+	for m.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return ts, conn
+}
+
+// readNotices returns the notices the client got until the session ended, and the close code.
+func readNotices(conn *websocket.Conn, stop func(notice string) bool) ([]string, int) {
+	var notices []string
+	for {
+		typ, data, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return notices, closeErr.Code
+		}
+		if err != nil {
+			return notices, 0
+		}
+		c := control{}
+		if typ != websocket.TextMessage || unmarshalControl(data, &c) != nil || c.Kind != controlNotice {
+			continue
+		}
+		notices = append(notices, c.Message)
+		if stop != nil && stop(c.Message) {
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}
+	}
+}
+
+func TestSessionManagerShutdown(t *testing.T) {
+	t.Run("drained", func(t *testing.T) {
+		m := NewSessionManager()
+		ts, conn := newManagedSession(t, m)
+		defer ts.Close()
+		go readNotices(conn, func(string) bool { return true })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := m.Shutdown(ctx); err != nil {
+			t.Errorf("expected the session to be drained, got %v", err)
+		}
+		if m.Len() != 0 {
+			t.Errorf("expected no session left, got %d", m.Len())
+		}
+	})
+
+	t.Run("countdown and going away", func(t *testing.T) {
+		m := NewSessionManager(WithSessionManagerNoticeInterval(50 * time.Millisecond))
+		ts, conn := newManagedSession(t, m)
+		defer ts.Close()
+		type result struct {
+			notices []string
+			code    int
+		}
+		done := make(chan result, 1)
+		go func() {
+			notices, code := readNotices(conn, nil)
+			done <- result{notices, code}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		if err := m.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+		// the force closed session finished
+		if m.Len() != 0 {
+			t.Errorf("expected no session left, got %d", m.Len())
+		}
+
+		r := <-done
+		if r.code != websocket.CloseGoingAway {
+			t.Errorf("expected close code %d, got %d", websocket.CloseGoingAway, r.code)
+		}
+		if len(r.notices) < 3 || !strings.Contains(r.notices[0], "this session will be closed in") {
+			t.Errorf("expected a countdown, got %q", r.notices)
+		}
+	})
+
+	t.Run("concurrent without notice interval", func(t *testing.T) {
+		m := NewSessionManager(WithSessionManagerNoticeInterval(0))
+		ts, conn := newManagedSession(t, m)
+		defer ts.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = m.Shutdown(ctx)
+			}(i)
+		}
+		notices, _ := readNotices(conn, func(string) bool { return true })
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Errorf("expected shutdown %d to return once drained, got %v", i, err)
+			}
+		}
+		if len(notices) == 0 {
+			t.Errorf("expected a notice")
+		}
+	})
+
+	t.Run("client not reading", func(t *testing.T) {
+		// without a write timeout the writes to the session block, notices and the close message too
+		m := NewSessionManager(
+			WithSessionManagerNoticeInterval(20*time.Millisecond),
+			WithSessionManagerServerOptions(WithServerCloseTimeout(100*time.Millisecond)),
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, err := m.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			go func() {
+				chunk := make([]byte, 64*1024)
+				for {
+					if _, err := s.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			s.Keepalive()
+		}))
+		defer ts.Close()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for m.Len() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		// the buffers of the connection fill up
+		time.Sleep(200 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- m.Shutdown(ctx)
+		}()
+		select {
+		case err = <-shutdown:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected shutdown to close the session of a client that doesn't read")
+		}
+		if m.Len() != 0 {
+			t.Errorf("expected no session left, got %d", m.Len())
+		}
+	})
+
+	t.Run("rejected after shutdown", func(t *testing.T) {
+		m := NewSessionManager()
+		if err := m.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = m.Upgrade(w, r, nil)
+		}))
+		defer ts.Close()
+
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %v %v", resp, err)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package wsexec
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeTar writes a tar archive of paths, directories recursively. Entries are named after the base
+// name of their path like kubectl cp does, only directories and regular files are archived.
+func writeTar(w io.Writer, paths []string) error {
+	tw := tar.NewWriter(w)
+	for _, root := range paths {
+		root = filepath.Clean(root)
+		parent := filepath.Dir(root)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() && !info.IsDir() {
+				return nil
+			}
+
+			name, err := filepath.Rel(parent, path)
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(name)
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			if err = tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// extractTar extracts a tar archive into dir. Only directories and regular files are extracted,
+// entries that would end up outside of dir fail the extraction.
+func extractTar(r io.Reader, dir string) error {
+	dir = filepath.Clean(dir)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return fmt.Errorf("%w: %s", ErrUnsafeArchivePath, hdr.Name)
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(path, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err = extractFile(tr, path, mode); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -2,6 +2,10 @@ package wsexec
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
 )
 
 const (
@@ -9,8 +13,86 @@ const (
 	Escape            = '\u001b'
 )
 
+// Limits of the terminal size a client may request, larger sizes are rejected as malformed.
+const (
+	MaxTerminalWidth  = 4096
+	MaxTerminalHeight = 2048
+)
+
+// Websocket close codes in the private range telling the client why the server ended the session.
+const (
+	CloseSessionExpired = 4000
+	CloseSessionIdle    = 4001
+)
+
 var (
 	ErrTerminalSizeMonitorStopped = errors.New("terminal size monitor has been stopped")
 	ErrUnexpectedMessageType      = errors.New("received unexpected message type")
+	ErrServerGoingAway            = errors.New("server is going away")
+	ErrSessionManagerClosed       = errors.New("session manager has been shut down")
+	ErrSessionExpired             = errors.New("session reached its maximum duration")
+	ErrSessionIdle                = errors.New("session has been idle for too long")
+	ErrWriteTimeout               = errors.New("write to client timed out")
+	ErrMalformedMessage           = errors.New("received malformed message")
+	ErrChecksumMismatch           = errors.New("transfer checksum mismatch")
+	ErrUnsafeArchivePath          = errors.New("archive entry escapes the destination")
+	ErrUnsupportedTransfer        = errors.New("unsupported in band transfer")
+	ErrTransferCanceled           = errors.New("transfer canceled")
+	ErrRateLimiterNoBurst         = errors.New("rate limiter has no burst")
 )
 
+// closeCode returns the websocket close code sent to the peer when a session ends with err.
+func closeCode(err error) int {
+	switch {
+	case errors.Is(err, ErrServerGoingAway):
+		return websocket.CloseGoingAway
+	case errors.Is(err, ErrSessionExpired):
+		return CloseSessionExpired
+	case errors.Is(err, ErrSessionIdle):
+		return CloseSessionIdle
+	case errors.Is(err, ErrMalformedMessage):
+		return websocket.CloseInvalidFramePayloadData
+	case errors.Is(err, ErrUnexpectedMessageType):
+		return websocket.CloseUnsupportedData
+	default:
+		return websocket.CloseNormalClosure
+	}
+}
+
+// ExitError is returned by Client.Run when the remote process exited with a non-zero status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command terminated with exit code %d", e.Code)
+}
+
+// ExitStatus returns the exit status of the remote process, like k8s.io/client-go/util/exec.ExitError.
+func (e *ExitError) ExitStatus() int {
+	return e.Code
+}
+
+// exitStatus returns the exit status of the remote process when it ended the session with err.
+func exitStatus(err error) (int, bool) {
+	if err == nil {
+		return 0, true
+	}
+	var exitErr interface{ ExitStatus() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
+
+// ContainerChoiceError is returned when the container of a session is ambiguous, e.g. by
+// kube.ContainerSelector. It marshals to JSON, so a server can send it and the client can let the
+// user pick one of Containers.
+type ContainerChoiceError struct {
+	Pod        string   `json:"pod"`
+	Containers []string `json:"containers"`
+}
+
+func (e *ContainerChoiceError) Error() string {
+	return fmt.Sprintf("a container name must be specified for pod %s, choose one of: [%s]", e.Pod, strings.Join(e.Containers, " "))
+}
@@ -0,0 +1,70 @@
+package wsexec
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// sessionTimeouts tracks the maximum duration and idle timeout of a session.
+type sessionTimeouts struct {
+	maxDuration time.Duration
+	idleTimeout time.Duration
+	warning     time.Duration
+
+	startedAt    time.Time
+	lastActivity int64 // unix nanoseconds, accessed atomically
+
+	// expireWarned and idleWarnedFor, the last activity of the idle period the user was warned
+	// about, are only accessed by the keepalive goroutine
+	expireWarned  bool
+	idleWarnedFor int64
+}
+
+func (t *sessionTimeouts) enabled() bool {
+	return t.maxDuration > 0 || t.idleTimeout > 0
+}
+
+func (t *sessionTimeouts) start(now time.Time) {
+	t.startedAt = now
+	t.touch(now)
+}
+
+// touch records input or output activity.
+func (t *sessionTimeouts) touch(now time.Time) {
+	atomic.StoreInt64(&t.lastActivity, now.UnixNano())
+}
+
+// check returns ErrSessionExpired or ErrSessionIdle once a timeout has passed, otherwise the
+// warning to show the user when a timeout is near, or an empty string.
+func (t *sessionTimeouts) check(now time.Time) (string, error) {
+	if t.maxDuration > 0 {
+		remaining := t.startedAt.Add(t.maxDuration).Sub(now)
+		if remaining <= 0 {
+			return "", ErrSessionExpired
+		}
+		if remaining <= t.warning && !t.expireWarned {
+			t.expireWarned = true
+			return fmt.Sprintf("session reaches its maximum duration of %s and will be closed in %s", t.maxDuration, remaining.Round(time.Second)), nil
+		}
+	}
+
+	if t.idleTimeout > 0 {
+		last := atomic.LoadInt64(&t.lastActivity)
+		remaining := time.Unix(0, last).Add(t.idleTimeout).Sub(now)
+		if remaining <= 0 {
+			return "", ErrSessionIdle
+		}
+		// a warning as long as the timeout would follow every activity
+		warning := t.warning
+		if warning > t.idleTimeout/2 {
+			warning = t.idleTimeout / 2
+		}
+		if remaining <= warning && t.idleWarnedFor != last {
+			t.idleWarnedFor = last
+			return fmt.Sprintf("session has been idle and will be closed in %s without activity", remaining.Round(time.Second)), nil
+		}
+	}
+
+	return "", nil
+}
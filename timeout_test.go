@@ -0,0 +1,155 @@
+package wsexec
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionTimeoutsCheck(t *testing.T) {
+	start := time.Now()
+	timeouts := sessionTimeouts{idleTimeout: 10 * time.Minute, maxDuration: time.Hour, warning: time.Minute}
+	timeouts.start(start)
+
+	steps := []struct {
+		after   time.Duration
+		touch   bool
+		warning string
+		err     error
+	}{
+		{after: 5 * time.Minute},
+		{after: 9*time.Minute + 30*time.Second, warning: "session has been idle and will be closed in 30s without activity"},
+		// warned once
+		{after: 9*time.Minute + 40*time.Second},
+		{after: 9*time.Minute + 50*time.Second, touch: true},
+		{after: 15 * time.Minute},
+		{after: 59 * time.Minute, touch: true, warning: "session reaches its maximum duration of 1h0m0s and will be closed in 1m0s"},
+		{after: 60 * time.Minute, touch: true, err: ErrSessionExpired},
+	}
+	for i, step := range steps {
+		now := start.Add(step.after)
+		if step.touch {
+			timeouts.touch(now)
+		}
+		warning, err := timeouts.check(now)
+		if warning != step.warning || !errors.Is(err, step.err) {
+			t.Errorf("step %d: expected %q %v, got %q %v", i, step.warning, step.err, warning, err)
+		}
+	}
+
+	// the warning is shortened to half the idle timeout, and given again for every idle period
+	timeouts = sessionTimeouts{idleTimeout: time.Minute, warning: time.Minute}
+	timeouts.start(start)
+	steps = []struct {
+		after   time.Duration
+		touch   bool
+		warning string
+		err     error
+	}{
+		{after: time.Second},
+		{after: 30 * time.Second, warning: "session has been idle and will be closed in 30s without activity"},
+		{after: 40 * time.Second, touch: true},
+		{after: 41 * time.Second},
+		{after: 70 * time.Second, warning: "session has been idle and will be closed in 30s without activity"},
+		{after: 80 * time.Second},
+		{after: 100 * time.Second, err: ErrSessionIdle},
+	}
+	for i, step := range steps {
+		now := start.Add(step.after)
+		if step.touch {
+			timeouts.touch(now)
+		}
+		warning, err := timeouts.check(now)
+		if warning != step.warning || !errors.Is(err, step.err) {
+			t.Errorf("short idle timeout step %d: expected %q %v, got %q %v", i, step.warning, step.err, warning, err)
+		}
+	}
+
+	timeouts = sessionTimeouts{idleTimeout: 10 * time.Minute}
+	timeouts.start(start)
+	if _, err := timeouts.check(start.Add(10 * time.Minute)); !errors.Is(err, ErrSessionIdle) {
+		t.Errorf("expected %v, got %v", ErrSessionIdle, err)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	idle := 1500 * time.Millisecond
+	testcases := map[string]struct {
+		input  bool
+		output bool
+		closed bool
+	}{
+		"pings aren't activity": {closed: true},
+		"input":                 {input: true},
+		"output":                {output: true},
+	}
+	for k, tc := range testcases {
+		tc := tc
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			s := NewServer(conn, WithServerIdleTimeout(idle), WithServerTimeoutWarning(0))
+			go s.Keepalive()
+			for tc.output {
+				select {
+				case <-s.Done():
+					return
+				case <-time.After(300 * time.Millisecond):
+					_, _ = s.Write([]byte("tick"))
+				}
+			}
+			<-s.Done()
+		}))
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := make(chan int, 1)
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					var closeErr *websocket.CloseError
+					if errors.As(err, &closeErr) {
+						closed <- closeErr.Code
+					}
+					close(closed)
+					return
+				}
+			}
+		}()
+
+		deadline := time.After(2 * idle)
+		code, ended := 0, false
+	loop:
+		for {
+			select {
+			case code, ended = <-closed:
+				break loop
+			case <-deadline:
+				break loop
+			case <-time.After(300 * time.Millisecond):
+				if tc.input {
+					_ = conn.WriteMessage(websocket.BinaryMessage, []byte("a"))
+				} else {
+					_ = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+				}
+			}
+		}
+		if tc.closed && code != CloseSessionIdle {
+			t.Errorf("%s: expected close code %d, got %d %t", k, CloseSessionIdle, code, ended)
+		}
+		if !tc.closed && ended {
+			t.Errorf("%s: expected the session to stay open, closed with %d", k, code)
+		}
+		conn.Close()
+		ts.Close()
+	}
+}
@@ -0,0 +1,235 @@
+package wsexec
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// A transfer copies files into or out of the target like kubectl cp. It has a session of its own
+// that carries a tar archive instead of a terminal, so it never mixes with a shell. The sender ends
+// the archive with a checksum control message, which the receiver compares with what it got.
+
+// TransferDirection tells whether a transfer copies files into or out of the target.
+type TransferDirection string
+
+const (
+	TransferUpload   TransferDirection = "upload"
+	TransferDownload TransferDirection = "download"
+)
+
+// checksum hashes an archive as it goes through.
+type checksum struct {
+	hash hash.Hash
+	size int64
+}
+
+func newChecksum() *checksum {
+	return &checksum{hash: sha256.New()}
+}
+
+func (c *checksum) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.hash.Write(p)
+}
+
+func (c *checksum) control() control {
+	return control{Kind: controlChecksum, Checksum: hex.EncodeToString(c.hash.Sum(nil)), Size: c.size}
+}
+
+// verify compares the checksum with the one the peer sent.
+func (c *checksum) verify(peer *control) error {
+	if peer == nil {
+		return fmt.Errorf("%w: the archive wasn't complete", ErrChecksumMismatch)
+	}
+	expected := c.control()
+	if peer.Checksum != expected.Checksum || peer.Size != expected.Size {
+		return fmt.Errorf("%w: sent %d bytes sha256 %s, received %d bytes sha256 %s",
+			ErrChecksumMismatch, peer.Size, peer.Checksum, expected.Size, expected.Checksum)
+	}
+	return nil
+}
+
+// Transfer is the server side of a transfer, the exec backend reads the uploaded archive from it or
+// writes the archive to download to it, see kube.Executor.Transfer.
+type Transfer struct {
+	s         *Server
+	direction TransferDirection
+	checksum  *checksum
+	// mu serializes Read, the stdin copier of the exec backend may outlive the command
+	mu sync.Mutex
+}
+
+func NewTransfer(s *Server, direction TransferDirection) *Transfer {
+	return &Transfer{s: s, direction: direction, checksum: newChecksum()}
+}
+
+func (t *Transfer) Direction() TransferDirection {
+	return t.direction
+}
+
+// Context returns the session context.
+func (t *Transfer) Context() context.Context {
+	return t.s.Context()
+}
+
+// Read returns the uploaded archive, io.EOF once the client sent its checksum.
+func (t *Transfer) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, err := t.s.Read(p)
+	_, _ = t.checksum.Write(p[:n])
+	return n, err
+}
+
+// Write sends the archive to download.
+func (t *Transfer) Write(p []byte) (int, error) {
+	n, err := t.s.Write(p)
+	_, _ = t.checksum.Write(p[:n])
+	return n, err
+}
+
+// Close ends the session with the error of the exec backend. A download is followed by its checksum,
+// an upload is checked against the checksum of the client, which learns the outcome from the exit status.
+func (t *Transfer) Close(err error) {
+	if err == nil {
+		switch t.direction {
+		case TransferDownload:
+			err = t.s.writeControl(t.checksum.control())
+		case TransferUpload:
+			err = t.verifyUpload()
+		}
+	}
+	t.s.Close(err)
+}
+
+func (t *Transfer) verifyUpload() error {
+	// tar may stop reading at the end of archive marker, the padding after it counts as well
+	if _, err := io.Copy(io.Discard, t); err != nil {
+		return err
+	}
+
+	t.s.Lock()
+	peer := t.s.peerChecksum
+	t.s.Unlock()
+	return t.checksum.verify(peer)
+}
+
+// progressWriter reports how many bytes went through.
+type progressWriter struct {
+	fn func(int64)
+	n  int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	if w.fn != nil {
+		w.fn(w.n)
+	}
+	return len(p), nil
+}
+
+// Upload sends a tar archive of paths to a session the server runs as a TransferUpload, directories
+// are sent recursively. It returns once the server extracted the archive and verified its checksum.
+func (cli *Client) Upload(paths ...string) error {
+	go cli.send()
+	go cli.flushOut(io.Discard)
+	go func() {
+		if err := cli.sendArchive(paths); err != nil {
+			cli.logger.Println("send archive err ", err)
+			cli.errChan <- fmt.Errorf("send archive %w", err)
+		}
+	}()
+
+	return cli.transferResult(<-cli.errChan, nil)
+}
+
+func (cli *Client) sendArchive(paths []string) error {
+	sum := newChecksum()
+	w := io.MultiWriter(writerFunc(func(p []byte) (int, error) {
+		// the send goroutine keeps the message, it needs a copy of the buffer of the tar writer
+		cli.sendData(append([]byte(nil), p...))
+		return len(p), nil
+	}), sum, &progressWriter{fn: cli.progress})
+	if err := writeTar(w, paths); err != nil {
+		return err
+	}
+
+	data, err := marshalControl(sum.control())
+	if err != nil {
+		return err
+	}
+	cli.writeChan <- newControlMessage(data)
+	return nil
+}
+
+// Download extracts the tar archive of a session the server runs as a TransferDownload into dir.
+// It returns once the whole archive has been extracted and its checksum verified.
+func (cli *Client) Download(dir string) error {
+	go cli.send()
+	if cli.outputWindow.size > 0 {
+		if err := cli.grantCredit(cli.outputWindow.size); err != nil {
+			return err
+		}
+	}
+
+	pr, pw := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := extractTar(pr, dir)
+		// keep the output flowing until the session ends, whatever follows the archive
+		_, _ = io.Copy(io.Discard, pr)
+		extracted <- err
+	}()
+
+	sum := newChecksum()
+	go cli.flushOut(io.MultiWriter(pw, sum, &progressWriter{fn: cli.progress}))
+
+	err := <-cli.errChan
+	_ = pw.Close()
+	extractErr := <-extracted
+	return cli.transferResult(err, func() error {
+		if extractErr != nil {
+			return fmt.Errorf("extract archive %w", extractErr)
+		}
+		peer, _ := cli.checksum.Load().(control)
+		if peer.Kind == "" {
+			return sum.verify(nil)
+		}
+		return sum.verify(&peer)
+	})
+}
+
+// transferResult returns the outcome of a transfer that ended with err, verify checks what was received.
+func (cli *Client) transferResult(err error, verify func() error) error {
+	var closeError *websocket.CloseError
+	if !errors.As(err, &closeError) {
+		return err
+	}
+
+	code, ok := cli.exitCode.Load().(int)
+	if !ok {
+		return fmt.Errorf("transfer failed: %w", closeError)
+	}
+	if code != 0 {
+		return fmt.Errorf("%w: %s", &ExitError{Code: code}, closeError.Text)
+	}
+	if verify != nil {
+		return verify()
+	}
+	return nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
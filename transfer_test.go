@@ -0,0 +1,133 @@
+package wsexec
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// transferServer runs transfers with backend in place of the exec backend.
+func transferServer(direction TransferDirection, backend func(t *Transfer) error) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s := NewServer(conn, WithServerFlowControl(4096))
+		go s.Keepalive()
+		t := NewTransfer(s, direction)
+		t.Close(backend(t))
+		<-s.Done()
+	}))
+}
+
+func dialTransfer(t *testing.T, ts *httptest.Server) *Client {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(conn, WithClientFlowControl(4096))
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("read %s: %s", name, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s: expected %d bytes, got %d", name, len(content), len(got))
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	files := map[string]string{
+		"conf/app.yaml":     "replicas: 3\n",
+		"conf/data/big.bin": strings.Repeat("0123456789abcdef", 64*1024),
+		"conf/empty":        "",
+	}
+	src, dst := t.TempDir(), t.TempDir()
+	writeFiles(t, src, files)
+
+	// the backend extracts uploads into dst and archives downloads from src, like tar in the target
+	upload := transferServer(TransferUpload, func(t *Transfer) error {
+		return extractTar(t, dst)
+	})
+	defer upload.Close()
+	var uploaded int64
+	cli := dialTransfer(t, upload)
+	cli.progress = func(n int64) { uploaded = n }
+	if err := cli.Upload(filepath.Join(src, "conf")); err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	checkFiles(t, dst, files)
+	if uploaded < 1<<20 {
+		t.Errorf("expected progress of at least 1MiB, got %d", uploaded)
+	}
+
+	download := transferServer(TransferDownload, func(t *Transfer) error {
+		return writeTar(t, []string{filepath.Join(dst, "conf")})
+	})
+	defer download.Close()
+	out := t.TempDir()
+	if err := dialTransfer(t, download).Download(out); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	checkFiles(t, out, files)
+
+	failed := transferServer(TransferDownload, func(t *Transfer) error {
+		return &ExitError{Code: 2}
+	})
+	defer failed.Close()
+	var exitErr *ExitError
+	if err := dialTransfer(t, failed).Download(t.TempDir()); !errors.As(err, &exitErr) || exitErr.Code != 2 {
+		t.Errorf("expected exit code 2, got %v", err)
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	testcases := map[string]struct {
+		name string
+		err  error
+	}{
+		"plain":         {name: "a/b.txt"},
+		"parent":        {name: "../b.txt", err: ErrUnsafeArchivePath},
+		"nested parent": {name: "a/../../b.txt", err: ErrUnsafeArchivePath},
+		"absolute":      {name: "/etc/b.txt"},
+		"dot":           {name: "./b.txt"},
+	}
+	for k, tc := range testcases {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		_ = tw.WriteHeader(&tar.Header{Name: tc.name, Mode: 0644, Size: 2, Typeflag: tar.TypeReg})
+		_, _ = io.WriteString(tw, "hi")
+		_ = tw.Close()
+
+		if err := extractTar(buf, t.TempDir()); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected err %v, got %v", k, tc.err, err)
+		}
+	}
+}
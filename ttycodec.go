@@ -0,0 +1,189 @@
+package wsexec
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Websocket subprotocols of the ttyd and gotty JS frontends, enable them with
+// WithSessionManagerSubprotocols. Authentication happens on upgrade, the AuthToken and the
+// gotty Arguments of the init message are ignored, so the target must be in the request url.
+const (
+	SubprotocolTTYD    = "tty"
+	SubprotocolGotty   = "webtty"
+	SubprotocolGottyV1 = "gotty"
+)
+
+// ttyInitPrefix starts the JSON init message both frontends send first.
+const ttyInitPrefix = '{'
+
+// ttySize is the terminal size of both frontends.
+type ttySize struct {
+	Columns uint16 `json:"columns"`
+	Rows    uint16 `json:"rows"`
+}
+
+func unmarshalTTYSize(data []byte) (*remotecommand.TerminalSize, error) {
+	size := ttySize{}
+	if err := json.Unmarshal(data, &size); err != nil {
+		return nil, fmt.Errorf("%w: terminal size %s", ErrMalformedMessage, err)
+	}
+	return &remotecommand.TerminalSize{Width: size.Columns, Height: size.Rows}, nil
+}
+
+// ttyNotice returns the output showing c, as neither frontend has a message for it.
+func ttyNotice(c control) ([]byte, bool) {
+	switch c.Kind {
+	case controlNotice, controlInfo:
+		return []byte(noticeLine(c.Message)), true
+	case controlExit:
+		if c.ExitCode == nil || *c.ExitCode == 0 {
+			return nil, false
+		}
+		return []byte(noticeLine(c.Message)), true
+	default:
+		// e.g. credit, the frontends don't do flow control
+		return nil, false
+	}
+}
+
+// Commands of ttyd, the first byte of every message.
+const (
+	ttydInput  = '0'
+	ttydResize = '1'
+	ttydPause  = '2'
+	ttydResume = '3'
+
+	ttydOutput = '0'
+)
+
+// ttydCodec is the protocol of ttyd, messages are binary and start with a command byte. The init
+// message carries the terminal size.
+type ttydCodec struct{}
+
+func (ttydCodec) greeting() ([]message, error) {
+	return nil, nil
+}
+
+func (ttydCodec) encodeOutput(p []byte) message {
+	data := make([]byte, 1+len(p))
+	data[0] = ttydOutput
+	copy(data[1:], p)
+	return message{Type: websocket.BinaryMessage, Data: data}
+}
+
+func (c ttydCodec) encodeControl(ctl control) (message, bool, error) {
+	output, ok := ttyNotice(ctl)
+	if !ok {
+		return message{}, false, nil
+	}
+	return c.encodeOutput(output), true, nil
+}
+
+func (ttydCodec) decode(messageType int, data []byte) (frame, error) {
+	// ttyd before 1.6 sends text messages
+	if messageType != websocket.BinaryMessage && messageType != websocket.TextMessage {
+		return frame{}, ErrUnexpectedMessageType
+	}
+	if len(data) == 0 {
+		return frame{}, nil
+	}
+
+	switch data[0] {
+	case ttydInput:
+		if len(data) == 1 {
+			return frame{}, nil
+		}
+		return frame{input: data[1:]}, nil
+	case ttydResize:
+		size, err := unmarshalTTYSize(data[1:])
+		return frame{size: size}, err
+	case ttyInitPrefix:
+		size, err := unmarshalTTYSize(data)
+		return frame{size: size}, err
+	case ttydPause, ttydResume:
+		// the output is only held back by flow control and the rate limits
+		return frame{}, nil
+	default:
+		return frame{}, fmt.Errorf("%w: unknown ttyd command %q", ErrMalformedMessage, data[0])
+	}
+}
+
+// Commands of gotty 2, gotty 1 uses the same commands shifted by one.
+const (
+	gottyInput  = '1'
+	gottyPing   = '2'
+	gottyResize = '3'
+
+	gottyOutput = '1'
+	gottyPong   = '2'
+)
+
+// gottyCodec is the protocol of gotty, messages are text and start with a command byte, output is
+// base64 encoded.
+type gottyCodec struct {
+	// shift is subtracted from the commands of gotty 2
+	shift byte
+}
+
+func newGottyCodec(subprotocol string) gottyCodec {
+	if subprotocol == SubprotocolGottyV1 {
+		return gottyCodec{shift: 1}
+	}
+	return gottyCodec{}
+}
+
+func (gottyCodec) greeting() ([]message, error) {
+	return nil, nil
+}
+
+func (c gottyCodec) encode(command byte, p []byte) message {
+	data := make([]byte, 1+base64.StdEncoding.EncodedLen(len(p)))
+	data[0] = command - c.shift
+	base64.StdEncoding.Encode(data[1:], p)
+	return message{Type: websocket.TextMessage, Data: data}
+}
+
+func (c gottyCodec) encodeOutput(p []byte) message {
+	return c.encode(gottyOutput, p)
+}
+
+func (c gottyCodec) encodeControl(ctl control) (message, bool, error) {
+	output, ok := ttyNotice(ctl)
+	if !ok {
+		return message{}, false, nil
+	}
+	return c.encodeOutput(output), true, nil
+}
+
+func (c gottyCodec) decode(messageType int, data []byte) (frame, error) {
+	if messageType != websocket.TextMessage {
+		return frame{}, ErrUnexpectedMessageType
+	}
+	if len(data) == 0 {
+		return frame{}, nil
+	}
+	if data[0] == ttyInitPrefix {
+		return frame{}, nil
+	}
+
+	switch data[0] + c.shift {
+	case gottyInput:
+		if len(data) == 1 {
+			return frame{}, nil
+		}
+		return frame{input: data[1:]}, nil
+	case gottyPing:
+		pong := message{Type: websocket.TextMessage, Data: []byte{gottyPong - c.shift}}
+		return frame{reply: &pong}, nil
+	case gottyResize:
+		size, err := unmarshalTTYSize(data[1:])
+		return frame{size: size}, err
+	default:
+		return frame{}, fmt.Errorf("%w: unknown gotty command %q", ErrMalformedMessage, data[0])
+	}
+}
@@ -0,0 +1,77 @@
+package wsexec
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestTTYCodecDecode(t *testing.T) {
+	testcases := map[string]struct {
+		subprotocol string
+		messageType int
+		data        string
+		expected    frame
+		err         error
+	}{
+		"ttyd init":       {subprotocol: SubprotocolTTYD, messageType: websocket.BinaryMessage, data: `{"AuthToken":"","columns":120,"rows":30}`, expected: frame{size: &remotecommand.TerminalSize{Width: 120, Height: 30}}},
+		"ttyd input":      {subprotocol: SubprotocolTTYD, messageType: websocket.BinaryMessage, data: "0ls\r", expected: frame{input: []byte("ls\r")}},
+		"ttyd text input": {subprotocol: SubprotocolTTYD, messageType: websocket.TextMessage, data: "0ls\r", expected: frame{input: []byte("ls\r")}},
+		"ttyd resize":     {subprotocol: SubprotocolTTYD, messageType: websocket.BinaryMessage, data: `1{"columns":80,"rows":24}`, expected: frame{size: &remotecommand.TerminalSize{Width: 80, Height: 24}}},
+		"ttyd pause":      {subprotocol: SubprotocolTTYD, messageType: websocket.BinaryMessage, data: "2"},
+		"ttyd unknown":    {subprotocol: SubprotocolTTYD, messageType: websocket.BinaryMessage, data: "9", err: ErrMalformedMessage},
+		"gotty init":      {subprotocol: SubprotocolGotty, messageType: websocket.TextMessage, data: `{"Arguments":"?pod=web-0","AuthToken":""}`},
+		"gotty input":     {subprotocol: SubprotocolGotty, messageType: websocket.TextMessage, data: "1ls\r", expected: frame{input: []byte("ls\r")}},
+		"gotty ping":      {subprotocol: SubprotocolGotty, messageType: websocket.TextMessage, data: "2", expected: frame{reply: &message{Type: websocket.TextMessage, Data: []byte("2")}}},
+		"gotty resize":    {subprotocol: SubprotocolGotty, messageType: websocket.TextMessage, data: `3{"columns":80,"rows":24}`, expected: frame{size: &remotecommand.TerminalSize{Width: 80, Height: 24}}},
+		"gotty binary":    {subprotocol: SubprotocolGotty, messageType: websocket.BinaryMessage, data: "1ls", err: ErrUnexpectedMessageType},
+		"gotty v1 input":  {subprotocol: SubprotocolGottyV1, messageType: websocket.TextMessage, data: "0ls\r", expected: frame{input: []byte("ls\r")}},
+		"gotty v1 ping":   {subprotocol: SubprotocolGottyV1, messageType: websocket.TextMessage, data: "1", expected: frame{reply: &message{Type: websocket.TextMessage, Data: []byte("1")}}},
+	}
+	for k, tc := range testcases {
+		got, err := codecFor(tc.subprotocol).decode(tc.messageType, []byte(tc.data))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected err %v, got %v", k, tc.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", k, tc.expected, got)
+		}
+	}
+}
+
+func TestTTYCodecEncode(t *testing.T) {
+	code := 1
+	testcases := map[string]struct {
+		subprotocol string
+		output      string
+		control     control
+		expected    message
+		ok          bool
+	}{
+		"ttyd output":     {subprotocol: SubprotocolTTYD, output: "hi", expected: message{Type: websocket.BinaryMessage, Data: []byte("0hi")}, ok: true},
+		"ttyd notice":     {subprotocol: SubprotocolTTYD, control: control{Kind: controlNotice, Message: "bye"}, expected: message{Type: websocket.BinaryMessage, Data: []byte("0\r\n[wsexec] bye\r\n")}, ok: true},
+		"ttyd info":       {subprotocol: SubprotocolTTYD, control: control{Kind: controlInfo, Message: "connected to pod default/web-1", Pod: "web-1"}, expected: message{Type: websocket.BinaryMessage, Data: []byte("0\r\n[wsexec] connected to pod default/web-1\r\n")}, ok: true},
+		"ttyd credit":     {subprotocol: SubprotocolTTYD, control: control{Kind: controlCredit, Credit: 1}},
+		"gotty output":    {subprotocol: SubprotocolGotty, output: "hi", expected: message{Type: websocket.TextMessage, Data: []byte("1aGk=")}, ok: true},
+		"gotty exit":      {subprotocol: SubprotocolGotty, control: control{Kind: controlExit, ExitCode: &code, Message: "x"}, expected: message{Type: websocket.TextMessage, Data: []byte("1DQpbd3NleGVjXSB4DQo=")}, ok: true},
+		"gotty v1 output": {subprotocol: SubprotocolGottyV1, output: "hi", expected: message{Type: websocket.TextMessage, Data: []byte("0aGk=")}, ok: true},
+	}
+	for k, tc := range testcases {
+		c := codecFor(tc.subprotocol)
+		got, ok := c.encodeOutput([]byte(tc.output)), true
+		if tc.control.Kind != "" {
+			var err error
+			if got, ok, err = c.encodeControl(tc.control); err != nil {
+				t.Errorf("%s: %s", k, err)
+				continue
+			}
+		}
+		if ok != tc.ok || ok && !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %v %q, got %v %q", k, tc.ok, tc.expected.Data, ok, got.Data)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package wsexec
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"path"
+)
+
+// Default locations of xterm.js, see WithWebHandlerXterm.
+const (
+	DefaultXtermScript = "https://cdn.jsdelivr.net/npm/xterm@4.19.0/lib/xterm.js"
+	DefaultXtermStyle  = "https://cdn.jsdelivr.net/npm/xterm@4.19.0/css/xterm.css"
+	DefaultFitScript   = "https://cdn.jsdelivr.net/npm/xterm-addon-fit@0.5.0/lib/xterm-addon-fit.js"
+)
+
+//go:embed web
+var webAssets embed.FS
+
+var webIndex = template.Must(template.ParseFS(webAssets, "web/index.html"))
+
+// WebHandler serves a web terminal page along with wsexec.js, the JS client of the wsexec protocol.
+// The page opens a session at the exec url with its own query, so mounted at "/terminal/" the page
+// "/terminal/?pod=web-0&command=sh" execs sh in pod web-0 through the handler of "/exec".
+type WebHandler struct {
+	title       string
+	execURL     string
+	xtermScript string
+	xtermStyle  string
+	fitScript   string
+	script      []byte
+}
+
+type WebHandlerOption func(*WebHandler)
+
+// WithWebHandlerTitle sets the title of the page.
+func WithWebHandlerTitle(title string) WebHandlerOption {
+	return func(h *WebHandler) {
+		h.title = title
+	}
+}
+
+// WithWebHandlerExecURL sets the url of the exec websocket, relative to the page, by default it's "/exec".
+func WithWebHandlerExecURL(url string) WebHandlerOption {
+	return func(h *WebHandler) {
+		h.execURL = url
+	}
+}
+
+// WithWebHandlerXterm loads xterm.js, its stylesheet and its fit addon from the given urls instead
+// of a CDN, e.g. to serve them along with the page.
+func WithWebHandlerXterm(script, style, fitScript string) WebHandlerOption {
+	return func(h *WebHandler) {
+		h.xtermScript = script
+		h.xtermStyle = style
+		h.fitScript = fitScript
+	}
+}
+
+// NewWebHandler returns a handler to mount under a path ending with a slash, e.g.
+// http.Handle("/terminal/", wsexec.NewWebHandler()).
+func NewWebHandler(options ...WebHandlerOption) *WebHandler {
+	script, err := webAssets.ReadFile("web/wsexec.js")
+	if err != nil {
+		panic(err)
+	}
+
+	h := &WebHandler{
+		title:       "wsexec",
+		execURL:     "/exec",
+		xtermScript: DefaultXtermScript,
+		xtermStyle:  DefaultXtermStyle,
+		fitScript:   DefaultFitScript,
+		script:      script,
+	}
+
+	for _, opt := range options {
+		opt(h)
+	}
+
+	return h
+}
+
+func (h *WebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if path.Base(r.URL.Path) == "wsexec.js" {
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		_, _ = w.Write(h.script)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the page is useless in a frame, don't let other sites trick users into typing in it
+	w.Header().Set("X-Frame-Options", "DENY")
+	data := struct {
+		Title, ExecURL, XtermScript, XtermStyle, FitScript string
+	}{h.title, h.execURL, h.xtermScript, h.xtermStyle, h.fitScript}
+	if err := webIndex.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
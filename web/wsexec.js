@@ -0,0 +1,163 @@
+// wsexec.js connects an xterm.js terminal to a wsexec server.
+//
+//   var session = WSExec.connect(term, WSExec.url("/exec"), {
+//     onexit: function (status) { console.log(status.code, status.closeCode, status.reason, status.target); }
+//   });
+//
+// Output is binary messages, input is sent as binary messages, resizes and control messages are
+// JSON text messages, see message.go.
+(function (global) {
+  "use strict";
+
+  // CLOSE_NORMAL is the close code of a session that ended on its own, the reason of other close
+  // codes tells the user why the server ended the session
+  var CLOSE_NORMAL = 1000;
+  // DEFAULT_WINDOW is the output credit granted to the server, see flowcontrol.go
+  var DEFAULT_WINDOW = 256 * 1024;
+
+  var encoder = new TextEncoder();
+
+  function Session(term, url, options) {
+    options = options || {};
+    this.term = term;
+    this.window = options.window === undefined ? DEFAULT_WINDOW : options.window;
+    this.onexit = options.onexit || function () {};
+    this.consumed = 0;
+    this.exitCode = null;
+    // target is the pod the server resolved the session to, see Server.Info, null until it says
+    this.target = null;
+    this.disposables = [];
+
+    var self = this;
+    this.ws = new WebSocket(url);
+    this.ws.binaryType = "arraybuffer";
+    this.ws.onopen = function () { self.open(); };
+    this.ws.onmessage = function (ev) { self.receive(ev.data); };
+    this.ws.onclose = function (ev) { self.closed(ev.code, ev.reason); };
+  }
+
+  Session.prototype.open = function () {
+    var self = this;
+    if (this.window > 0) {
+      this.control({ kind: "credit", credit: this.window });
+    }
+    this.resize(this.term.cols, this.term.rows);
+
+    this.disposables.push(this.term.onData(function (data) {
+      self.send(encoder.encode(data));
+    }));
+    // e.g. mouse reports in X10 mode, every char is a single byte
+    this.disposables.push(this.term.onBinary(function (data) {
+      var bytes = new Uint8Array(data.length);
+      for (var i = 0; i < data.length; i++) {
+        bytes[i] = data.charCodeAt(i) & 0xff;
+      }
+      self.send(bytes);
+    }));
+    this.disposables.push(this.term.onResize(function (size) {
+      self.resize(size.cols, size.rows);
+    }));
+  };
+
+  Session.prototype.receive = function (data) {
+    if (typeof data === "string") {
+      this.handleControl(JSON.parse(data));
+      return;
+    }
+
+    // credit is handed back once xterm.js has rendered the output, so a busy browser slows down
+    // the remote process instead of buffering without bounds
+    var self = this;
+    var n = data.byteLength;
+    this.term.write(new Uint8Array(data), function () { self.consume(n); });
+  };
+
+  Session.prototype.handleControl = function (c) {
+    switch (c.kind) {
+      case "notice":
+        this.notice(c.message);
+        break;
+      case "info":
+        this.target = { namespace: c.namespace, pod: c.pod, container: c.container };
+        this.notice(c.message);
+        break;
+      case "exit":
+        this.exitCode = c.exitCode;
+        break;
+      case "credit":
+        // keystrokes are tiny, input credit isn't tracked
+        break;
+    }
+  };
+
+  Session.prototype.consume = function (n) {
+    if (this.window <= 0) {
+      return;
+    }
+    this.consumed += n;
+    if (this.consumed >= this.window / 2) {
+      this.control({ kind: "credit", credit: this.consumed });
+      this.consumed = 0;
+    }
+  };
+
+  Session.prototype.closed = function (code, reason) {
+    this.disposables.forEach(function (d) { d.dispose(); });
+    this.disposables = [];
+
+    if (code !== CLOSE_NORMAL && reason) {
+      this.notice(reason);
+    } else if (this.exitCode === null) {
+      this.notice("connection closed");
+    } else if (this.exitCode !== 0) {
+      this.notice("command exited with status " + this.exitCode);
+    }
+    this.onexit({ code: this.exitCode, closeCode: code, reason: reason, target: this.target });
+  };
+
+  Session.prototype.notice = function (message) {
+    this.term.write("\r\n[wsexec] " + message + "\r\n");
+  };
+
+  Session.prototype.resize = function (cols, rows) {
+    if (this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify({ Width: cols, Height: rows }));
+    }
+  };
+
+  Session.prototype.send = function (bytes) {
+    if (this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(bytes);
+    }
+  };
+
+  Session.prototype.control = function (c) {
+    if (this.ws.readyState === WebSocket.OPEN) {
+      this.ws.send(JSON.stringify(c));
+    }
+  };
+
+  // close ends the session, the remote process gets a hangup.
+  Session.prototype.close = function () {
+    this.ws.close(CLOSE_NORMAL);
+  };
+
+  global.WSExec = {
+    // connect opens a session in term, a Terminal of xterm.js.
+    connect: function (term, url, options) {
+      return new Session(term, url, options);
+    },
+    // url returns the websocket url of path relative to the page, the query of the page, e.g.
+    // namespace, pod, container, command and csrf_token, is passed on.
+    url: function (path, search) {
+      var u = new URL(path, global.location.href);
+      u.protocol = u.protocol === "https:" ? "wss:" : "ws:";
+      new URLSearchParams(search === undefined ? global.location.search : search).forEach(function (value, key) {
+        if (!u.searchParams.has(key)) {
+          u.searchParams.append(key, value);
+        }
+      });
+      return u.toString();
+    }
+  };
+})(window);
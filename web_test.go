@@ -0,0 +1,37 @@
+package wsexec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebHandler(t *testing.T) {
+	h := NewWebHandler(WithWebHandlerExecURL("/api/exec"), WithWebHandlerTitle("<debug>"))
+	testcases := map[string]struct {
+		path        string
+		contentType string
+		contains    []string
+	}{
+		"page":         {path: "/terminal/", contentType: "text/html; charset=utf-8", contains: []string{`data-exec-url="/api/exec"`, "<title>&lt;debug&gt;</title>", DefaultXtermScript}},
+		"page query":   {path: "/terminal/?pod=web-0&command=sh", contentType: "text/html; charset=utf-8", contains: []string{`src="wsexec.js"`}},
+		"client":       {path: "/terminal/wsexec.js", contentType: "text/javascript; charset=utf-8", contains: []string{"global.WSExec"}},
+		"mounted root": {path: "/wsexec.js", contentType: "text/javascript; charset=utf-8", contains: []string{`kind: "credit"`}},
+	}
+	for k, tc := range testcases {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", k, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != tc.contentType {
+			t.Errorf("%s: expected content type %q, got %q", k, tc.contentType, got)
+		}
+		for _, s := range tc.contains {
+			if !strings.Contains(rec.Body.String(), s) {
+				t.Errorf("%s: expected body to contain %q", k, s)
+			}
+		}
+	}
+}